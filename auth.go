@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const sessionCookieName = "helios_session"
+
+type User struct {
+	ID           uint      `gorm:"primaryKey;size:32" json:"id"`
+	Username     string    `gorm:"type:varchar(64);uniqueIndex" json:"username"`
+	PasswordHash string    `gorm:"type:varchar(128)" json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// LoginSession 登录态，TokenHash 为cookie中令牌的sha256，数据库泄露也无法直接冒用
+type LoginSession struct {
+	TokenHash string    `gorm:"primaryKey;type:varchar(64)"`
+	UserID    uint      `gorm:"size:32;index"`
+	User      *User     `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+type AuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+var errUsernameTaken = errors.New("用户名已存在")
+
+type ctxKey int
+
+const userCtxKey ctxKey = 0
+
+// currentUser 取requireAuth写入的当前用户
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userCtxKey).(*User)
+	return u
+}
+
+// currentUserID 仅在requireAuth保护的接口中调用
+func currentUserID(r *http.Request) uint {
+	return currentUser(r).ID
+}
+
+// requireAuth 校验登录cookie，未登录返回401
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := userFromCookie(r)
+		if user == nil {
+			http.Error(w, "请先登录", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userCtxKey, user)))
+	})
+}
+
+func userFromCookie(r *http.Request) *User {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	var ls LoginSession
+	if err := db.Preload("User").Where("token_hash = ?", hashToken(c.Value)).First(&ls).Error; err != nil {
+		return nil
+	}
+	if time.Now().After(ls.ExpiresAt) {
+		db.Delete(&ls)
+		return nil
+	}
+	return ls.User
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateCredentials(req AuthRequest) error {
+	name := strings.TrimSpace(req.Username)
+	if n := utf8.RuneCountInString(name); n < 3 || n > 32 || strings.ContainsAny(name, " \t\r\n") {
+		return errors.New("用户名需为3-32个字符且不含空白")
+	}
+	if len(req.Password) < 6 || len(req.Password) > 72 {
+		return errors.New("密码长度需为6-72位")
+	}
+	return nil
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	if err := validateCredentials(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "注册失败", http.StatusInternalServerError)
+		return
+	}
+	user := User{Username: strings.TrimSpace(req.Username), PasswordHash: string(hash)}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var exists int64
+		tx.Model(&User{}).Where("username = ?", user.Username).Count(&exists)
+		if exists > 0 {
+			return errUsernameTaken
+		}
+		var userCount int64
+		tx.Model(&User{}).Count(&userCount)
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		// 第一个注册的用户认领升级前没有归属的会话和人格
+		if userCount == 0 {
+			if err := tx.Model(&Session{}).Where("user_id IS NULL").Update("user_id", user.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Persona{}).Where("user_id IS NULL").Update("user_id", user.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errUsernameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "注册失败", http.StatusInternalServerError)
+		return
+	}
+	if err := startLoginSession(w, user.ID); err != nil {
+		http.Error(w, "登录失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": "success", "user": user})
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	var user User
+	if err := db.Where("username = ?", strings.TrimSpace(req.Username)).First(&user).Error; err != nil {
+		http.Error(w, "用户名或密码错误", http.StatusUnauthorized)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		http.Error(w, "用户名或密码错误", http.StatusUnauthorized)
+		return
+	}
+	db.Where("user_id = ? AND expires_at < ?", user.ID, time.Now()).Delete(&LoginSession{})
+	if err := startLoginSession(w, user.ID); err != nil {
+		http.Error(w, "登录失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": "success", "user": user})
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookieName); err == nil && c.Value != "" {
+		db.Where("token_hash = ?", hashToken(c.Value)).Delete(&LoginSession{})
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   cfg.Auth.SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"result": "success"})
+}
+
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentUser(r))
+}
+
+// startLoginSession 生成随机令牌写入cookie，数据库只保存其哈希
+func startLoginSession(w http.ResponseWriter, userID uint) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(buf)
+	expires := time.Now().Add(cfg.Auth.SessionTTL.Duration)
+	if err := db.Create(&LoginSession{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		ExpiresAt: expires,
+	}).Error; err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   cfg.Auth.SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+	// 注册WebP解码器，avatarFormats中的格式都要能被image.Decode识别
+	_ "golang.org/x/image/webp"
+)
+
+// 上传的头像按内容识别格式（PNG/JPEG/WebP），完整解码后居中裁成正方形，缩放到标准尺寸并另存一张缩略图。
+// 重新编码后不保留EXIF等元数据，JPEG的拍摄方向会先应用到图像上。文件名取处理结果的哈希，重复上传不会产生新文件
+
+// avatarFormats 允许的格式，键为http.DetectContentType的结果，值为image.Decode返回的格式名
+var avatarFormats = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpeg",
+	"image/webp": "webp",
+}
+
+// StoredAvatar 保存后的头像和缩略图地址
+type StoredAvatar struct {
+	URL      string
+	ThumbURL string
+}
+
+// saveAvatar 裁剪缩放decodeAvatar得到的图片并写入上传目录，内容相同的图片返回同一个地址
+func saveAvatar(img image.Image) (StoredAvatar, error) {
+	square := cropSquare(img)
+	full, ext, err := encodeAvatar(resizeSquare(square, cfg.Upload.AvatarSize))
+	if err != nil {
+		return StoredAvatar{}, err
+	}
+	thumb, _, err := encodeAvatar(resizeSquare(square, cfg.Upload.ThumbSize))
+	if err != nil {
+		return StoredAvatar{}, err
+	}
+	sum := sha256.Sum256(full)
+	name := "avatar_" + hex.EncodeToString(sum[:16])
+	if err := os.MkdirAll(cfg.Upload.Dir, 0755); err != nil {
+		return StoredAvatar{}, err
+	}
+	if err := writeFileOnce(filepath.Join(cfg.Upload.Dir, name+ext), full); err != nil {
+		return StoredAvatar{}, err
+	}
+	if err := writeFileOnce(filepath.Join(cfg.Upload.Dir, name+"_thumb"+ext), thumb); err != nil {
+		return StoredAvatar{}, err
+	}
+	return StoredAvatar{
+		URL:      cfg.Upload.URLPrefix + name + ext,
+		ThumbURL: cfg.Upload.URLPrefix + name + "_thumb" + ext,
+	}, nil
+}
+
+// decodeAvatar 按文件内容而不是扩展名判断格式，解码前先检查尺寸，防止超大图片占满内存
+func decodeAvatar(data []byte) (image.Image, error) {
+	format, ok := avatarFormats[http.DetectContentType(data)]
+	if !ok {
+		return nil, errors.New("仅支持PNG/JPEG/WebP图片")
+	}
+	conf, confFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || confFormat != format {
+		return nil, errors.New("图片已损坏或格式不正确")
+	}
+	if conf.Width <= 0 || conf.Height <= 0 || conf.Width*conf.Height > cfg.Upload.MaxPixels {
+		return nil, fmt.Errorf("图片尺寸%dx%d超出限制", conf.Width, conf.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("图片已损坏或格式不正确")
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// cropSquare 取中间的正方形区域
+func cropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+	rect := image.Rect(x, y, x+side, y+side)
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
+
+func resizeSquare(img image.Image, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// encodeAvatar 有透明部分时保存为PNG，否则保存为JPEG以减小体积
+func encodeAvatar(img *image.RGBA) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if img.Opaque() {
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+		return buf.Bytes(), ".jpg", err
+	}
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), ".png", err
+}
+
+// writeFileOnce 文件已存在时视为重复上传，直接复用；先写临时文件再改名，避免并发上传读到半个文件
+func writeFileOnce(path string, data []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// jpegOrientation 读取JPEG中EXIF的Orientation（1-8），没有或无法解析时返回1
+func jpegOrientation(data []byte) int {
+	// 跳过SOI，逐个查看APPn段，遇到图像数据前停止
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || size < 2 || i+2+size > len(data) {
+			break
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation 在TIFF结构的第一个IFD中查找0x0112标签
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < n; k++ {
+		e := ifd + 2 + k*12
+		if e+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// applyOrientation 把EXIF方向应用到像素上，去掉元数据后图片仍然是正的
+func applyOrientation(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// 5-8需要转置，宽高互换
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
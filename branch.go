@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 消息以树的形式保存：每条消息记录ParentID，会话的HeadMessageID指向当前分支的最后一条消息。
+// 重新生成回复、编辑用户消息都会在原消息旁新增一个兄弟节点，旧分支保留，可随时切换回去
+
+type RegenerateRequest struct {
+	SessionID string `json:"sessionId"`
+	// MessageID 要重新生成的助手消息，为空时取当前分支的最后一条
+	MessageID uint `json:"messageId"`
+}
+
+type EditMessageRequest struct {
+	SessionID string `json:"sessionId"`
+	MessageID uint   `json:"messageId"`
+	Content   string `json:"content"`
+}
+
+type SwitchBranchRequest struct {
+	SessionID string `json:"sessionId"`
+	MessageID uint   `json:"messageId"`
+}
+
+// appendMessage 保存消息并把会话的当前分支移到它上面
+func appendMessage(msg *Message) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(msg).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Session{}).Where("id = ?", msg.SessionID).Update("head_message_id", msg.ID).Error
+	})
+}
+
+// pathTo 从leafID沿ParentID回溯到根，按时间顺序返回该分支上的消息；leafID为空时返回空分支
+func pathTo(sessionID string, leafID *uint) ([]Message, error) {
+	if leafID == nil {
+		return nil, nil
+	}
+	var msgs []Message
+	if err := db.Where("session_id = ?", sessionID).Order("id asc").Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]Message, len(msgs))
+	for _, m := range msgs {
+		byID[m.ID] = m
+	}
+	var path []Message
+	for id := *leafID; ; {
+		m, ok := byID[id]
+		if !ok {
+			break
+		}
+		path = append(path, m)
+		// 父消息总是先创建，ID更小，顺带防止脏数据成环
+		if m.ParentID == nil || *m.ParentID >= m.ID {
+			break
+		}
+		id = *m.ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
+
+// activePath 会话当前分支上的全部消息
+func activePath(session Session) ([]Message, error) {
+	return pathTo(session.ID, session.HeadMessageID)
+}
+
+// messageTree 只含ID和父子关系的消息树，分页、填充兄弟节点时不必读取消息内容
+type messageTree struct {
+	parent   map[uint]*uint
+	children map[uint][]uint
+	roots    []uint
+}
+
+func loadMessageTree(sessionID string) (*messageTree, error) {
+	var all []Message
+	if err := db.Select("id", "parent_id").Where("session_id = ?", sessionID).Order("id asc").Find(&all).Error; err != nil {
+		return nil, err
+	}
+	t := &messageTree{parent: make(map[uint]*uint, len(all)), children: make(map[uint][]uint)}
+	for _, m := range all {
+		t.parent[m.ID] = m.ParentID
+		if m.ParentID == nil {
+			t.roots = append(t.roots, m.ID)
+		} else {
+			t.children[*m.ParentID] = append(t.children[*m.ParentID], m.ID)
+		}
+	}
+	return t, nil
+}
+
+// pathIDs 与pathTo相同的回溯规则，只返回ID
+func (t *messageTree) pathIDs(leafID *uint) []uint {
+	if leafID == nil {
+		return nil
+	}
+	var ids []uint
+	for id := *leafID; ; {
+		p, ok := t.parent[id]
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+		if p == nil || *p >= id {
+			break
+		}
+		id = *p
+	}
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids
+}
+
+// fillSiblings 为每条消息填充同一父消息下的全部候选，前端据此显示“2/3”并切换
+func (t *messageTree) fillSiblings(msgs []Message) {
+	for i := range msgs {
+		sibs := t.roots
+		if msgs[i].ParentID != nil {
+			sibs = t.children[*msgs[i].ParentID]
+		}
+		if len(sibs) > 1 {
+			msgs[i].Siblings = sibs
+		}
+	}
+}
+
+// latestLeaf 从某条消息一路沿最新的子消息走到叶子
+func latestLeaf(sessionID string, id uint) (uint, error) {
+	for {
+		var child Message
+		err := db.Where("session_id = ? AND parent_id = ?", sessionID, id).Order("id desc").First(&child).Error
+		if err == gorm.ErrRecordNotFound {
+			return id, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		id = child.ID
+	}
+}
+
+// backfillMessageTree 升级前的消息没有ParentID，按ID顺序串成一条分支
+func backfillMessageTree(db *gorm.DB) error {
+	var sessionIDs []string
+	if err := db.Model(&Session{}).Where("head_message_id IS NULL").Pluck("id", &sessionIDs).Error; err != nil {
+		return err
+	}
+	for _, sid := range sessionIDs {
+		var msgs []Message
+		if err := db.Where("session_id = ?", sid).Order("id asc").Find(&msgs).Error; err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for i := 1; i < len(msgs); i++ {
+				if err := tx.Model(&Message{}).Where("id = ?", msgs[i].ID).Update("parent_id", msgs[i-1].ID).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Model(&Session{}).Where("id = ?", sid).Update("head_message_id", msgs[len(msgs)-1].ID).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findMessage 查会话内的某条消息
+func findMessage(sessionID string, id uint) (Message, error) {
+	var m Message
+	err := db.Where("id = ? AND session_id = ?", id, sessionID).First(&m).Error
+	return m, err
+}
+
+// replyTo 以userMsg所在分支为上下文调用模型，回复作为userMsg的子消息保存；
+// 群聊中speakerID为指定的回复成员，为空时按发言顺序选择。userMsg是本次新保存的消息时，出错后由调用方撤销
+func replyTo(session Session, userMsg Message, speakerID *uint) (map[string]interface{}, error) {
+	speaker, err := speakerSession(session, userMsg.ParentID, userMsg.Content, speakerID)
+	if err != nil {
+		return nil, fmt.Errorf("选择回复成员失败")
+	}
+	chatMsgs, ctxStats, err := buildChatMessages(speaker, userMsg.ParentID, userMsg.Content)
+	if err != nil {
+		return nil, fmt.Errorf("获取历史消息失败")
+	}
+	startTime := time.Now()
+	response, err := callChatModel(speaker, chatMsgs)
+	elapsedTime := time.Since(startTime)
+	if err != nil {
+		log.Printf("模型调用失败 session=%s: %v", session.ID, err)
+		return nil, newUpstreamError(err)
+	}
+	aiMsg, err := saveAssistantReply(speaker, userMsg.ID, response, elapsedTime)
+	if err != nil {
+		log.Printf("会话%s保存回复失败: %v", session.ID, err)
+		return nil, fmt.Errorf("保存回复失败")
+	}
+	scheduleMemoryUpdate(session)
+	return chatReplyResponse(speaker, aiMsg, response, elapsedTime, ctxStats), nil
+}
+
+// writeReplyError 模型调用失败时使用对应的状态码，其余错误为500
+func writeReplyError(w http.ResponseWriter, err error) {
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		http.Error(w, ue.Message, ue.Status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// regenerateReply 为同一条用户消息重新生成回复，旧回复作为兄弟分支保留
+func regenerateReply(w http.ResponseWriter, r *http.Request) {
+	var req RegenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	session, ok := loadActiveSession(w, currentUserID(r), req.SessionID)
+	if !ok {
+		return
+	}
+	if !enforceLimits(w, currentUserID(r), session.ID) {
+		return
+	}
+	if req.MessageID == 0 {
+		if session.HeadMessageID == nil {
+			http.Error(w, "没有可重新生成的回复", http.StatusBadRequest)
+			return
+		}
+		req.MessageID = *session.HeadMessageID
+	}
+	target, err := findMessage(session.ID, req.MessageID)
+	if err != nil {
+		http.Error(w, "消息不存在", http.StatusNotFound)
+		return
+	}
+	if target.Role != "assistant" || target.ParentID == nil {
+		http.Error(w, "只能重新生成助手的回复", http.StatusBadRequest)
+		return
+	}
+	userMsg, err := findMessage(session.ID, *target.ParentID)
+	if err != nil || userMsg.Role != "user" {
+		http.Error(w, "只能重新生成助手的回复", http.StatusBadRequest)
+		return
+	}
+	// 群聊中仍由原来的成员重新回复
+	resp, err := replyTo(session, userMsg, target.PersonaID)
+	if err != nil {
+		writeReplyError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// editMessage 修改一条用户消息并从那里重新对话，修改后的消息作为原消息的兄弟分支
+func editMessage(w http.ResponseWriter, r *http.Request) {
+	var req EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" || req.MessageID == 0 || req.Content == "" {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	session, ok := loadActiveSession(w, currentUserID(r), req.SessionID)
+	if !ok {
+		return
+	}
+	if !enforceLimits(w, currentUserID(r), session.ID) {
+		return
+	}
+	target, err := findMessage(session.ID, req.MessageID)
+	if err != nil {
+		http.Error(w, "消息不存在", http.StatusNotFound)
+		return
+	}
+	if target.Role != "user" {
+		http.Error(w, "只能编辑用户消息", http.StatusBadRequest)
+		return
+	}
+	userMsg := Message{
+		SessionID: session.ID,
+		ParentID:  target.ParentID,
+		Role:      "user",
+		Content:   req.Content,
+	}
+	if err := appendMessage(&userMsg); err != nil {
+		http.Error(w, "保存消息失败", http.StatusInternalServerError)
+		return
+	}
+	resp, err := replyTo(session, userMsg, nil)
+	if err != nil {
+		discardUserMessage(session, userMsg)
+		writeReplyError(w, err)
+		return
+	}
+	resp["userMessageId"] = userMsg.ID
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// switchBranch 切换到包含某条消息的分支，之后的部分沿最新的子消息延伸
+func switchBranch(w http.ResponseWriter, r *http.Request) {
+	var req SwitchBranchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" || req.MessageID == 0 {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	session, ok := loadActiveSession(w, currentUserID(r), req.SessionID)
+	if !ok {
+		return
+	}
+	if _, err := findMessage(session.ID, req.MessageID); err != nil {
+		http.Error(w, "消息不存在", http.StatusNotFound)
+		return
+	}
+	leaf, err := latestLeaf(session.ID, req.MessageID)
+	if err != nil {
+		http.Error(w, "切换分支失败", http.StatusInternalServerError)
+		return
+	}
+	if err := db.Model(&Session{}).Where("id = ?", session.ID).Update("head_message_id", leaf).Error; err != nil {
+		http.Error(w, "切换分支失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": "success", "headMessageId": leaf})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// CharacterCard 角色卡V2格式（chara_card_v2），与SillyTavern等工具通用
+type CharacterCard struct {
+	Spec        string            `json:"spec"`
+	SpecVersion string            `json:"spec_version"`
+	Data        CharacterCardData `json:"data"`
+}
+
+// CharacterCardData V1卡片的字段直接位于顶层，字段名与V2的data相同
+type CharacterCardData struct {
+	Name                    string                 `json:"name"`
+	Description             string                 `json:"description"`
+	Personality             string                 `json:"personality"`
+	Scenario                string                 `json:"scenario"`
+	FirstMes                string                 `json:"first_mes"`
+	MesExample              string                 `json:"mes_example"`
+	CreatorNotes            string                 `json:"creator_notes"`
+	SystemPrompt            string                 `json:"system_prompt"`
+	PostHistoryInstructions string                 `json:"post_history_instructions"`
+	AlternateGreetings      []string               `json:"alternate_greetings"`
+	Tags                    []string               `json:"tags"`
+	Creator                 string                 `json:"creator"`
+	CharacterVersion        string                 `json:"character_version"`
+	Extensions              map[string]interface{} `json:"extensions"`
+}
+
+// cardExtensionKey 卡片extensions中保存本项目专有字段的键
+const cardExtensionKey = "helios"
+
+// PNG角色卡把base64编码的卡片JSON放在关键字为chara的tEXt块中
+const pngCardKeyword = "chara"
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+type pngChunk struct {
+	Type string
+	Data []byte
+}
+
+// cardFromPersona 字段映射：description=外貌，personality=人格特点，system_prompt=提示词模板，身份放在extensions.helios.identity
+func cardFromPersona(p Persona) CharacterCard {
+	return CharacterCard{
+		Spec:        "chara_card_v2",
+		SpecVersion: "2.0",
+		Data: CharacterCardData{
+			Name:               p.Name,
+			Description:        p.Appearance,
+			Personality:        p.Personality,
+			SystemPrompt:       p.PromptTemplate,
+			AlternateGreetings: []string{},
+			Tags:               []string{},
+			Extensions: map[string]interface{}{
+				cardExtensionKey: map[string]string{"identity": p.Identity},
+			},
+		},
+	}
+}
+
+// parseCard 同时兼容V2（及结构相同的V3）和V1卡片
+func parseCard(raw []byte) (CharacterCardData, error) {
+	var card CharacterCard
+	if err := json.Unmarshal(raw, &card); err != nil {
+		return CharacterCardData{}, err
+	}
+	data := card.Data
+	if !strings.HasPrefix(card.Spec, "chara_card_") {
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return CharacterCardData{}, err
+		}
+	}
+	if strings.TrimSpace(data.Name) == "" {
+		return CharacterCardData{}, errors.New("角色卡缺少name")
+	}
+	return data, nil
+}
+
+// personaFromCard 没有身份扩展字段的外部卡片，身份留空；场景并入外貌描述；
+// system_prompt作为提示词模板，其中不支持的宏导致模板无效时忽略，使用默认模板
+func personaFromCard(d CharacterCardData) Persona {
+	identity := ""
+	if ext, ok := d.Extensions[cardExtensionKey].(map[string]interface{}); ok {
+		identity, _ = ext["identity"].(string)
+	}
+	appearance := d.Description
+	if d.Scenario != "" {
+		appearance = strings.TrimSpace(appearance + "\n\n场景：" + d.Scenario)
+	}
+	promptTemplate := strings.TrimSpace(d.SystemPrompt)
+	if validatePromptTemplate(promptTemplate) != nil {
+		promptTemplate = ""
+	}
+	return Persona{
+		Name:           truncateRunes(strings.TrimSpace(d.Name), 64),
+		Identity:       truncateRunes(identity, 128),
+		Appearance:     appearance,
+		Personality:    d.Personality,
+		PromptTemplate: promptTemplate,
+	}
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+func readPNGChunks(b []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return nil, errors.New("不是PNG文件")
+	}
+	var chunks []pngChunk
+	for p := len(pngSignature); p < len(b); {
+		if p+8 > len(b) {
+			return nil, errors.New("PNG文件已损坏")
+		}
+		n := int(binary.BigEndian.Uint32(b[p:]))
+		if n < 0 || p+12+n > len(b) {
+			return nil, errors.New("PNG文件已损坏")
+		}
+		chunks = append(chunks, pngChunk{Type: string(b[p+4 : p+8]), Data: b[p+8 : p+8+n]})
+		p += 12 + n
+	}
+	return chunks, nil
+}
+
+func writePNGChunks(chunks []pngChunk) []byte {
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	for _, c := range chunks {
+		var head [8]byte
+		binary.BigEndian.PutUint32(head[:4], uint32(len(c.Data)))
+		copy(head[4:], c.Type)
+		buf.Write(head[:])
+		buf.Write(c.Data)
+		crc := crc32.NewIEEE()
+		crc.Write(head[4:])
+		crc.Write(c.Data)
+		binary.Write(&buf, binary.BigEndian, crc.Sum32())
+	}
+	return buf.Bytes()
+}
+
+// isCardChunk 本项目写入的chara块，以及V3卡片使用的ccv3块
+func isCardChunk(c pngChunk) bool {
+	return c.Type == "tEXt" && (bytes.HasPrefix(c.Data, []byte(pngCardKeyword+"\x00")) || bytes.HasPrefix(c.Data, []byte("ccv3\x00")))
+}
+
+// cardFromPNG 取出PNG中的卡片JSON，并返回去掉卡片后的纯头像
+func cardFromPNG(b []byte) ([]byte, []byte, error) {
+	chunks, err := readPNGChunks(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 同时存在时优先使用V2的chara块
+	var encoded []byte
+	kept := chunks[:0:0]
+	for _, c := range chunks {
+		if !isCardChunk(c) {
+			kept = append(kept, c)
+			continue
+		}
+		keyword, text, _ := bytes.Cut(c.Data, []byte{0})
+		if encoded == nil || string(keyword) == pngCardKeyword {
+			encoded = text
+		}
+	}
+	if encoded == nil {
+		return nil, nil, errors.New("PNG中没有角色卡数据")
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, nil, errors.New("角色卡数据不是有效的base64")
+	}
+	return raw, writePNGChunks(kept), nil
+}
+
+// embedCard 把卡片写入PNG的IEND之前，已有的卡片块会被替换
+func embedCard(img []byte, card []byte) ([]byte, error) {
+	chunks, err := readPNGChunks(img)
+	if err != nil {
+		return nil, err
+	}
+	text := pngChunk{Type: "tEXt", Data: append([]byte(pngCardKeyword+"\x00"), base64.StdEncoding.EncodeToString(card)...)}
+	var out []pngChunk
+	for _, c := range chunks {
+		if isCardChunk(c) {
+			continue
+		}
+		if c.Type == "IEND" {
+			out = append(out, text)
+		}
+		out = append(out, c)
+	}
+	return writePNGChunks(out), nil
+}
+
+// avatarFile 把头像URL映射回本地文件，外部地址返回空
+func avatarFile(avatarURL string) string {
+	if strings.HasPrefix(avatarURL, cfg.Upload.URLPrefix) {
+		return filepath.Join(cfg.Upload.Dir, filepath.Base(strings.TrimPrefix(avatarURL, cfg.Upload.URLPrefix)))
+	}
+	if strings.HasPrefix(avatarURL, "/static/") {
+		return filepath.Join("static", filepath.Clean("/"+strings.TrimPrefix(avatarURL, "/static/")))
+	}
+	return ""
+}
+
+// avatarPNG 读取人格头像并转成PNG，没有可用头像时使用默认头像
+func avatarPNG(p Persona) ([]byte, error) {
+	b, err := os.ReadFile(avatarFile(p.Avatar))
+	if err != nil {
+		if b, err = os.ReadFile("static/ai_avatar.png"); err != nil {
+			return nil, err
+		}
+	}
+	if bytes.HasPrefix(b, pngSignature) {
+		return b, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// importPersonaCard 上传JSON或PNG角色卡创建人格，PNG的图片部分保存为头像
+func importPersonaCard(w http.ResponseWriter, r *http.Request) {
+	b, ok := readUpload(w, r, "card", "角色卡")
+	if !ok {
+		return
+	}
+
+	raw, avatar := b, []byte(nil)
+	if bytes.HasPrefix(b, pngSignature) {
+		var err error
+		if raw, avatar, err = cardFromPNG(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	data, err := parseCard(raw)
+	if err != nil {
+		http.Error(w, "角色卡格式错误: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	persona := personaFromCard(data)
+	userID := currentUserID(r)
+	persona.UserID = &userID
+
+	// 头像与手动上传的一样经过校验和处理，图片部分损坏时只导入卡片内容
+	if avatar != nil {
+		if img, err := decodeAvatar(avatar); err == nil {
+			stored, err := saveAvatar(img)
+			if err != nil {
+				http.Error(w, "文件保存失败", http.StatusInternalServerError)
+				return
+			}
+			persona.Avatar = stored.URL
+		}
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&persona).Error; err != nil {
+			return err
+		}
+		rev, err := recordPersonaRevision(tx, persona.ID, nil)
+		persona.Version = rev.Version
+		return err
+	})
+	if err != nil {
+		http.Error(w, "创建失败", http.StatusInternalServerError)
+		return
+	}
+	events.publish(userID, Event{Type: eventPersonaChanged, PersonaID: persona.ID, Name: persona.Name})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": "success", "persona": persona})
+}
+
+// exportPersonaCard 导出角色卡：format=json 为V2卡片JSON，format=png 为嵌入卡片的头像
+func exportPersonaCard(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var p Persona
+	if err := db.Where("user_id = ?", currentUserID(r)).First(&p, id).Error; err != nil {
+		http.Error(w, "未找到该人格", http.StatusNotFound)
+		return
+	}
+	card, err := json.Marshal(cardFromPersona(p))
+	if err != nil {
+		http.Error(w, "导出失败", http.StatusInternalServerError)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	var body []byte
+	var ext string
+	switch format {
+	case "", "json":
+		body, ext = card, "json"
+		w.Header().Set("Content-Type", "application/json")
+	case "png":
+		img, err := avatarPNG(p)
+		if err == nil {
+			body, err = embedCard(img, card)
+		}
+		if err != nil {
+			http.Error(w, "头像处理失败", http.StatusInternalServerError)
+			return
+		}
+		ext = "png"
+		w.Header().Set("Content-Type", "image/png")
+	default:
+		http.Error(w, "不支持的导出格式", http.StatusBadRequest)
+		return
+	}
+	name := p.Name + "." + ext
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="persona_%d.%s"; filename*=UTF-8''%s`, p.ID, ext, url.PathEscape(name)))
+	w.Write(body)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setupChatTest 测试库加上假后端作为唯一的模型，返回后端和已登录的用户
+func setupChatTest(t *testing.T) (*fakeProvider, *User) {
+	t.Helper()
+	openTestDB(t)
+	limiter = &rateLimiter{buckets: make(map[string]*rateBucket)}
+	fp := &fakeProvider{Record: true}
+	models = []*registeredModel{{
+		ModelConfig: ModelConfig{Name: "fake", Provider: "fake", Model: "fake", Capabilities: []string{"chat", "stream"}},
+		provider:    newResilientProvider(fp, RetryConfig{MaxAttempts: 1}, CircuitBreakerConfig{}),
+	}}
+	user := &User{Username: "alice"}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return fp, user
+}
+
+// callAPI 以user的身份调用handler，请求体为body的JSON
+func callAPI(t *testing.T, h http.HandlerFunc, user *User, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(b))
+	r = r.WithContext(context.WithValue(r.Context(), userCtxKey, user))
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func newTestSession(t *testing.T, user *User) Session {
+	t.Helper()
+	w := callAPI(t, handleSetup, user, ModelSetupRequest{Personality: "冷静"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("创建会话: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		SessionID string `json:"sessionId"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	session, err := findSession(user.ID, resp.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// expectBranch 当前分支上的角色依次为roles
+func expectBranch(t *testing.T, sessionID string, roles ...string) []Message {
+	t.Helper()
+	var session Session
+	if err := db.Where("id = ?", sessionID).First(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+	path, err := activePath(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range path {
+		got = append(got, m.Role)
+	}
+	if strings.Join(got, ",") != strings.Join(roles, ",") {
+		t.Fatalf("当前分支为%v，期望%v", got, roles)
+	}
+	return path
+}
+
+func TestHandleChat(t *testing.T) {
+	fp, user := setupChatTest(t)
+	session := newTestSession(t, user)
+
+	w := callAPI(t, handleChat, user, ChatRequest{SessionID: session.ID, Message: "你好"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码%d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		ID      uint   `json:"id"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Message != "[fake] 你好" {
+		t.Errorf("回复为%q", resp.Message)
+	}
+	path := expectBranch(t, session.ID, "system", "user", "assistant")
+	if path[2].ID != resp.ID {
+		t.Errorf("返回的id=%d，保存的回复为%d", resp.ID, path[2].ID)
+	}
+	if len(fp.Calls) != 1 || fp.Calls[0].Messages[0].Role != "system" {
+		t.Errorf("模型收到的请求: %+v", fp.Calls)
+	}
+	var usage UsageRecord
+	if err := db.Where("kind = ?", usageChat).First(&usage).Error; err != nil || usage.MessageID == nil || *usage.MessageID != resp.ID {
+		t.Errorf("用量记录%+v，期望关联回复%d", usage, resp.ID)
+	}
+}
+
+// TestHandleChatUpstreamError 模型调用失败时撤销本轮的用户消息
+func TestHandleChatUpstreamError(t *testing.T) {
+	fp, user := setupChatTest(t)
+	session := newTestSession(t, user)
+	fp.Reply = func(CompletionRequest) (string, error) {
+		return "", &APIError{StatusCode: http.StatusBadRequest, Body: "bad"}
+	}
+	w := callAPI(t, handleChat, user, ChatRequest{SessionID: session.ID, Message: "你好"})
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("状态码%d，期望502", w.Code)
+	}
+	expectBranch(t, session.ID, "system")
+	var n int64
+	db.Model(&Message{}).Where("session_id = ?", session.ID).Count(&n)
+	if n != 1 {
+		t.Errorf("会话中有%d条消息，期望只剩system", n)
+	}
+}
+
+func TestHandleChatStream(t *testing.T) {
+	fp, user := setupChatTest(t)
+	session := newTestSession(t, user)
+	fp.Reply = func(CompletionRequest) (string, error) { return "一二三四五六七八九", nil }
+
+	w := callAPI(t, handleChatStream, user, ChatRequest{SessionID: session.ID, Message: "数数"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码%d: %s", w.Code, w.Body.String())
+	}
+	var deltas []string
+	var done struct {
+		ID      uint   `json:"id"`
+		Message string `json:"message"`
+	}
+	event := ""
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "delta":
+			var d struct{ Content string }
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &d)
+			deltas = append(deltas, d.Content)
+		case strings.HasPrefix(line, "data: ") && event == "done":
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &done)
+		case strings.HasPrefix(line, "data: ") && event == "error":
+			t.Fatalf("收到error事件: %s", line)
+		}
+	}
+	if strings.Join(deltas, "|") != "一二三四|五六七八|九" {
+		t.Errorf("增量为%v", deltas)
+	}
+	if done.Message != "一二三四五六七八九" {
+		t.Errorf("done中的回复为%q", done.Message)
+	}
+	path := expectBranch(t, session.ID, "system", "user", "assistant")
+	if path[2].ID != done.ID || path[2].Content != done.Message {
+		t.Errorf("保存的回复%+v与done不一致", path[2])
+	}
+}
+
+// TestHandleChatStreamError 流式调用失败时推送error并撤销用户消息
+func TestHandleChatStreamError(t *testing.T) {
+	fp, user := setupChatTest(t)
+	session := newTestSession(t, user)
+	fp.Reply = func(CompletionRequest) (string, error) { return "", errors.New("boom") }
+
+	w := callAPI(t, handleChatStream, user, ChatRequest{SessionID: session.ID, Message: "你好"})
+	if !strings.Contains(w.Body.String(), "event: error") {
+		t.Errorf("没有error事件: %s", w.Body.String())
+	}
+	expectBranch(t, session.ID, "system")
+}
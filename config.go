@@ -0,0 +1,652 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config 运行配置，优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+type Config struct {
+	Server   ServerConfig   `yaml:"server" toml:"server"`
+	LLM      LLMConfig      `yaml:"llm" toml:"llm"`
+	Models   []ModelConfig  `yaml:"models" toml:"models"`
+	Database DatabaseConfig `yaml:"database" toml:"database"`
+	Upload   UploadConfig   `yaml:"upload" toml:"upload"`
+	Timeouts TimeoutConfig  `yaml:"timeouts" toml:"timeouts"`
+	Context  ContextConfig  `yaml:"context" toml:"context"`
+	Memory   MemoryConfig   `yaml:"memory" toml:"memory"`
+	Auth     AuthConfig     `yaml:"auth" toml:"auth"`
+	Pricing  PricingConfig  `yaml:"pricing" toml:"pricing"`
+	Limits   LimitsConfig   `yaml:"limits" toml:"limits"`
+
+	ExitIntent ExitIntentConfig `yaml:"exit_intent" toml:"exit_intent"`
+	Jobs       JobsConfig       `yaml:"jobs" toml:"jobs"`
+}
+
+type ServerConfig struct {
+	Listen      string   `yaml:"listen" toml:"listen"`
+	ReadTimeout Duration `yaml:"read_timeout" toml:"read_timeout"`
+}
+
+type LLMConfig struct {
+	// Provider 模型后端：openai（OpenAI兼容，如DeepSeek）/ anthropic / ollama / fake
+	Provider string `yaml:"provider" toml:"provider"`
+	// BaseURL 完整的对话接口地址
+	BaseURL string `yaml:"base_url" toml:"base_url"`
+	APIKey  string `yaml:"api_key" toml:"api_key"`
+	Model   string `yaml:"model" toml:"model"`
+
+	Retry          RetryConfig          `yaml:"retry" toml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker" toml:"circuit_breaker"`
+}
+
+// ModelConfig 模型注册表中的一项，未填写的provider、base_url、api_key沿用llm中的设置
+type ModelConfig struct {
+	// Name 会话中保存、前端显示和选择的模型名
+	Name     string `yaml:"name" toml:"name"`
+	Provider string `yaml:"provider" toml:"provider"`
+	BaseURL  string `yaml:"base_url" toml:"base_url"`
+	APIKey   string `yaml:"api_key" toml:"api_key"`
+	// Model 请求上游时使用的模型ID，为空时与Name相同
+	Model string `yaml:"model" toml:"model"`
+	// ContextWindow 上下文长度，为0时按模型ID前缀匹配
+	ContextWindow int `yaml:"context_window" toml:"context_window"`
+	// Capabilities 模型支持的能力，如 chat、stream、vision，供前端展示
+	Capabilities []string `yaml:"capabilities" toml:"capabilities"`
+}
+
+// RetryConfig 模型调用失败时的重试，只重试超时、网络错误、429和5xx，间隔按指数退避并加随机抖动
+type RetryConfig struct {
+	// MaxAttempts 含首次调用在内的最多尝试次数，1表示不重试
+	MaxAttempts int      `yaml:"max_attempts" toml:"max_attempts"`
+	BaseDelay   Duration `yaml:"base_delay" toml:"base_delay"`
+	MaxDelay    Duration `yaml:"max_delay" toml:"max_delay"`
+	// AttemptTimeout 单次尝试的超时，流式调用只计算到收到第一段内容为止；超时后在总超时内重试，0表示不限制
+	AttemptTimeout Duration `yaml:"attempt_timeout" toml:"attempt_timeout"`
+}
+
+// CircuitBreakerConfig 连续失败达到阈值后熔断，冷却期内直接失败，冷却结束放行一个请求试探
+type CircuitBreakerConfig struct {
+	// FailureThreshold 为0时不熔断
+	FailureThreshold int      `yaml:"failure_threshold" toml:"failure_threshold"`
+	Cooldown         Duration `yaml:"cooldown" toml:"cooldown"`
+}
+
+type DatabaseConfig struct {
+	// Driver mysql 或 sqlite；sqlite 的 DSN 为数据库文件路径，如 data/helios.db
+	Driver string `yaml:"driver" toml:"driver"`
+	DSN    string `yaml:"dsn" toml:"dsn"`
+}
+
+type UploadConfig struct {
+	// Dir 头像保存目录，URLPrefix 为对外访问路径
+	Dir       string `yaml:"dir" toml:"dir"`
+	URLPrefix string `yaml:"url_prefix" toml:"url_prefix"`
+	// MaxBytes 上传文件大小上限，MaxPixels 解码前按宽×高拒绝过大的图片
+	MaxBytes  int64 `yaml:"max_bytes" toml:"max_bytes"`
+	MaxPixels int   `yaml:"max_pixels" toml:"max_pixels"`
+	// AvatarSize 头像裁成正方形后的边长，ThumbSize 缩略图边长
+	AvatarSize int `yaml:"avatar_size" toml:"avatar_size"`
+	ThumbSize  int `yaml:"thumb_size" toml:"thumb_size"`
+}
+
+// TimeoutConfig 各类模型调用的超时
+type TimeoutConfig struct {
+	Chat       Duration `yaml:"chat" toml:"chat"`
+	Stream     Duration `yaml:"stream" toml:"stream"`
+	ExitIntent Duration `yaml:"exit_intent" toml:"exit_intent"`
+	Title      Duration `yaml:"title" toml:"title"`
+	Summary    Duration `yaml:"summary" toml:"summary"`
+}
+
+// ContextConfig 上下文窗口预算
+type ContextConfig struct {
+	// DefaultWindow 未知模型的上下文长度（token）
+	DefaultWindow int `yaml:"default_window" toml:"default_window"`
+	// ReserveTokens 为模型输出预留的token数
+	ReserveTokens int `yaml:"reserve_tokens" toml:"reserve_tokens"`
+	// KeepRecent 无论是否超出预算都保留的最近消息条数（含本轮用户输入）
+	KeepRecent int `yaml:"keep_recent" toml:"keep_recent"`
+	// Windows 按模型名前缀覆盖上下文长度
+	Windows map[string]int `yaml:"windows" toml:"windows"`
+}
+
+// MemoryConfig 滚动摘要（长期记忆）
+type MemoryConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// TriggerMessages 未被摘要覆盖的消息达到该条数时滚动一次
+	TriggerMessages int `yaml:"trigger_messages" toml:"trigger_messages"`
+	// KeepRecent 滚动时保留原文、不并入摘要的最近消息条数
+	KeepRecent int `yaml:"keep_recent" toml:"keep_recent"`
+}
+
+// AuthConfig 用户登录
+type AuthConfig struct {
+	// SecureCookie 为true时登录cookie只通过HTTPS发送，部署在HTTPS后应开启
+	SecureCookie bool `yaml:"secure_cookie" toml:"secure_cookie"`
+	// SessionTTL 登录有效期
+	SessionTTL Duration `yaml:"session_ttl" toml:"session_ttl"`
+}
+
+// PricingConfig 模型价格表，用于统计费用
+type PricingConfig struct {
+	Currency string `yaml:"currency" toml:"currency"`
+	// Models 按模型名前缀匹配，单价为每百万token的价格；未配置的模型费用记为0
+	Models map[string]ModelPrice `yaml:"models" toml:"models"`
+}
+
+type ModelPrice struct {
+	Prompt     float64 `yaml:"prompt" toml:"prompt"`
+	Completion float64 `yaml:"completion" toml:"completion"`
+}
+
+// LimitsConfig 调用模型的接口的频率限制和用量额度，分别作用于每个用户和每个会话
+type LimitsConfig struct {
+	User    LimitRule `yaml:"user" toml:"user"`
+	Session LimitRule `yaml:"session" toml:"session"`
+}
+
+// LimitRule 各项为0表示不限；费用额度的单位与 pricing.currency 相同
+type LimitRule struct {
+	RequestsPerMinute int     `yaml:"requests_per_minute" toml:"requests_per_minute"`
+	DailyTokens       int64   `yaml:"daily_tokens" toml:"daily_tokens"`
+	MonthlyTokens     int64   `yaml:"monthly_tokens" toml:"monthly_tokens"`
+	DailyCost         float64 `yaml:"daily_cost" toml:"daily_cost"`
+	MonthlyCost       float64 `yaml:"monthly_cost" toml:"monthly_cost"`
+}
+
+// ExitIntentConfig 退出意图识别，见exit_intent.go
+type ExitIntentConfig struct {
+	// Mode hybrid 本地无法确定时调用模型 / local 只用本地分类器 / llm 每条消息都调用模型
+	Mode string `yaml:"mode" toml:"mode"`
+	// ExitThreshold 本地得分不低于该值时直接判定为退出
+	ExitThreshold float64 `yaml:"exit_threshold" toml:"exit_threshold"`
+	// StayThreshold 本地得分不高于该值时直接判定为继续对话
+	StayThreshold float64 `yaml:"stay_threshold" toml:"stay_threshold"`
+	// ModelFile 可选的标注语料（JSON Lines，每行{"text":"...","exit":true}），启动时训练打分模型
+	ModelFile string `yaml:"model_file" toml:"model_file"`
+}
+
+// JobsConfig 后台任务队列，见jobs.go
+type JobsConfig struct {
+	Workers     int `yaml:"workers" toml:"workers"`
+	MaxAttempts int `yaml:"max_attempts" toml:"max_attempts"`
+	// PollInterval 空闲时检查新任务的间隔
+	PollInterval Duration `yaml:"poll_interval" toml:"poll_interval"`
+	// RetryDelay 第一次失败后的等待时间，之后每次翻倍
+	RetryDelay Duration `yaml:"retry_delay" toml:"retry_delay"`
+	// Lease 执行超过该时长的任务视为中断（如进程重启），会被重新领取
+	Lease Duration `yaml:"lease" toml:"lease"`
+	// Retention 已完成和死信任务的保留时长，从结束时算起
+	Retention Duration `yaml:"retention" toml:"retention"`
+}
+
+// Duration 配置文件中以 "30s"、"2m" 形式书写的时长
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(strings.TrimSpace(string(text)))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:      ":8888",
+			ReadTimeout: Duration{30 * time.Second},
+		},
+		LLM: LLMConfig{
+			Provider: "openai",
+			Retry: RetryConfig{
+				MaxAttempts:    3,
+				BaseDelay:      Duration{500 * time.Millisecond},
+				MaxDelay:       Duration{8 * time.Second},
+				AttemptTimeout: Duration{20 * time.Second},
+			},
+			CircuitBreaker: CircuitBreakerConfig{
+				FailureThreshold: 5,
+				Cooldown:         Duration{30 * time.Second},
+			},
+		},
+		Database: DatabaseConfig{
+			Driver: "mysql",
+		},
+		Upload: UploadConfig{
+			Dir:        "static/avatars",
+			URLPrefix:  "/static/avatars/",
+			MaxBytes:   10 << 20,
+			MaxPixels:  40000000,
+			AvatarSize: 512,
+			ThumbSize:  128,
+		},
+		Timeouts: TimeoutConfig{
+			Chat:       Duration{60 * time.Second},
+			Stream:     Duration{3 * time.Minute},
+			ExitIntent: Duration{15 * time.Second},
+			Title:      Duration{20 * time.Second},
+			Summary:    Duration{30 * time.Second},
+		},
+		Context: ContextConfig{
+			DefaultWindow: 8192,
+			ReserveTokens: 1024,
+			KeepRecent:    4,
+		},
+		Memory: MemoryConfig{
+			Enabled:         true,
+			TriggerMessages: 20,
+			KeepRecent:      8,
+		},
+		Auth: AuthConfig{
+			SessionTTL: Duration{7 * 24 * time.Hour},
+		},
+		Pricing: PricingConfig{
+			Currency: "USD",
+		},
+		Limits: LimitsConfig{
+			User:    LimitRule{RequestsPerMinute: 20},
+			Session: LimitRule{RequestsPerMinute: 10},
+		},
+		ExitIntent: ExitIntentConfig{
+			Mode:          exitIntentHybrid,
+			ExitThreshold: 0.85,
+			StayThreshold: 0.2,
+		},
+		Jobs: JobsConfig{
+			Workers:      2,
+			MaxAttempts:  3,
+			PollInterval: Duration{time.Second},
+			RetryDelay:   Duration{10 * time.Second},
+			Lease:        Duration{5 * time.Minute},
+			Retention:    Duration{72 * time.Hour},
+		},
+	}
+}
+
+// cliAction 命令行要求执行后直接退出的操作
+type cliAction struct {
+	// PrintConfig 打印生效配置（-print-config）
+	PrintConfig bool
+	// EvalExitIntent 用该标注语料评估本地退出意图分类器（-eval-exit-intent）
+	EvalExitIntent string
+}
+
+// loadConfig 依次合并默认值、配置文件、环境变量和命令行参数并校验
+func loadConfig(args []string) (*Config, cliAction, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("helios", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("HELIOS_CONFIG"), "配置文件路径（.yaml/.yml/.toml）")
+	printOnly := fs.Bool("print-config", false, "打印生效配置（敏感信息已脱敏）后退出")
+	evalExit := fs.String("eval-exit-intent", "", "用标注语料评估本地退出意图分类器后退出")
+	listen := fs.String("listen", "", "监听地址，如 :8888")
+	dbDriver := fs.String("db-driver", "", "数据库类型：mysql / sqlite")
+	dsn := fs.String("dsn", "", "数据库DSN")
+	provider := fs.String("llm-provider", "", "模型后端：openai / anthropic / ollama / fake")
+	baseURL := fs.String("llm-base-url", "", "模型接口地址")
+	modelName := fs.String("llm-model", "", "模型名称")
+	uploadDir := fs.String("upload-dir", "", "头像上传目录")
+	if err := fs.Parse(args); err != nil {
+		return nil, cliAction{}, err
+	}
+
+	path := *configPath
+	if path == "" {
+		for _, p := range []string{"config.yaml", "config.yml", "config.toml"} {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+	}
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, cliAction{}, fmt.Errorf("读取配置文件%s失败: %v", path, err)
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return nil, cliAction{}, err
+	}
+
+	overrides := map[string]*string{
+		"listen":       &c.Server.Listen,
+		"db-driver":    &c.Database.Driver,
+		"dsn":          &c.Database.DSN,
+		"llm-provider": &c.LLM.Provider,
+		"llm-base-url": &c.LLM.BaseURL,
+		"llm-model":    &c.LLM.Model,
+		"upload-dir":   &c.Upload.Dir,
+	}
+	values := map[string]*string{
+		"listen":       listen,
+		"db-driver":    dbDriver,
+		"dsn":          dsn,
+		"llm-provider": provider,
+		"llm-base-url": baseURL,
+		"llm-model":    modelName,
+		"upload-dir":   uploadDir,
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if dst, ok := overrides[f.Name]; ok {
+			*dst = *values[f.Name]
+		}
+	})
+
+	if err := c.Validate(); err != nil {
+		return nil, cliAction{}, err
+	}
+	return c, cliAction{PrintConfig: *printOnly, EvalExitIntent: *evalExit}, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(data, c)
+	case ".toml":
+		return toml.Unmarshal(data, c)
+	}
+	return fmt.Errorf("不支持的配置文件格式: %s", path)
+}
+
+// loadEnv 环境变量统一使用 HELIOS_ 前缀
+func (c *Config) loadEnv() error {
+	strs := map[string]*string{
+		"HELIOS_LISTEN":            &c.Server.Listen,
+		"HELIOS_LLM_PROVIDER":      &c.LLM.Provider,
+		"HELIOS_LLM_BASE_URL":      &c.LLM.BaseURL,
+		"HELIOS_LLM_API_KEY":       &c.LLM.APIKey,
+		"HELIOS_LLM_MODEL":         &c.LLM.Model,
+		"HELIOS_DB_DRIVER":         &c.Database.Driver,
+		"HELIOS_DB_DSN":            &c.Database.DSN,
+		"HELIOS_UPLOAD_DIR":        &c.Upload.Dir,
+		"HELIOS_UPLOAD_URL_PREFIX": &c.Upload.URLPrefix,
+		"HELIOS_EXIT_INTENT_MODE":  &c.ExitIntent.Mode,
+	}
+	for key, dst := range strs {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = v
+		}
+	}
+	durations := map[string]*Duration{
+		"HELIOS_READ_TIMEOUT":        &c.Server.ReadTimeout,
+		"HELIOS_TIMEOUT_CHAT":        &c.Timeouts.Chat,
+		"HELIOS_TIMEOUT_STREAM":      &c.Timeouts.Stream,
+		"HELIOS_TIMEOUT_EXIT_INTENT": &c.Timeouts.ExitIntent,
+		"HELIOS_TIMEOUT_TITLE":       &c.Timeouts.Title,
+		"HELIOS_TIMEOUT_SUMMARY":     &c.Timeouts.Summary,
+		"HELIOS_AUTH_SESSION_TTL":    &c.Auth.SessionTTL,
+	}
+	for key, dst := range durations {
+		if v, ok := os.LookupEnv(key); ok {
+			if err := dst.UnmarshalText([]byte(v)); err != nil {
+				return fmt.Errorf("环境变量%s格式错误: %v", key, err)
+			}
+		}
+	}
+	if v, ok := os.LookupEnv("HELIOS_AUTH_SECURE_COOKIE"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("环境变量HELIOS_AUTH_SECURE_COOKIE格式错误: %v", err)
+		}
+		c.Auth.SecureCookie = b
+	}
+	return nil
+}
+
+// modelConfigs 补全继承字段后的模型注册表；没有配置models时，用llm的设置生成唯一的一项。
+// 第一项为默认模型，新建会话未指定模型或会话记录的模型已不在注册表中时使用
+func (c *Config) modelConfigs() []ModelConfig {
+	if len(c.Models) == 0 {
+		name := c.LLM.Model
+		if name == "" {
+			name = "default"
+		}
+		return []ModelConfig{{
+			Name:         name,
+			Provider:     c.LLM.Provider,
+			BaseURL:      c.LLM.BaseURL,
+			APIKey:       c.LLM.APIKey,
+			Model:        c.LLM.Model,
+			Capabilities: []string{"chat", "stream"},
+		}}
+	}
+	out := make([]ModelConfig, len(c.Models))
+	for i, m := range c.Models {
+		if m.Provider == "" {
+			m.Provider = c.LLM.Provider
+		}
+		if m.BaseURL == "" {
+			m.BaseURL = c.LLM.BaseURL
+		}
+		if m.APIKey == "" {
+			m.APIKey = c.LLM.APIKey
+		}
+		if m.Model == "" {
+			m.Model = m.Name
+		}
+		if len(m.Capabilities) == 0 {
+			m.Capabilities = []string{"chat", "stream"}
+		}
+		out[i] = m
+	}
+	return out
+}
+
+// Validate 启动时校验配置，一次性返回全部问题
+func (c *Config) Validate() error {
+	var errs []string
+	if c.Server.Listen == "" {
+		errs = append(errs, "server.listen 不能为空")
+	}
+	// 配置了models时llm只提供各项未填写字段的默认值，由下面逐个模型校验合并后的结果
+	if len(c.Models) == 0 {
+		switch c.LLM.Provider {
+		case "openai", "anthropic":
+			if c.LLM.APIKey == "" {
+				errs = append(errs, "llm.api_key 不能为空")
+			}
+			fallthrough
+		case "ollama":
+			if u, err := url.Parse(c.LLM.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, "llm.base_url 必须是http(s)地址")
+			}
+			if c.LLM.Model == "" {
+				errs = append(errs, "llm.model 不能为空")
+			}
+		case "fake":
+		default:
+			errs = append(errs, fmt.Sprintf("未知的模型后端 llm.provider=%q", c.LLM.Provider))
+		}
+	}
+	seen := make(map[string]bool)
+	for i, m := range c.modelConfigs() {
+		if len(c.Models) == 0 {
+			break
+		}
+		prefix := fmt.Sprintf("models[%d]", i)
+		if m.Name == "" {
+			errs = append(errs, prefix+".name 不能为空")
+		} else if seen[strings.ToLower(m.Name)] {
+			errs = append(errs, fmt.Sprintf("%s.name=%q 重复", prefix, m.Name))
+		}
+		seen[strings.ToLower(m.Name)] = true
+		switch m.Provider {
+		case "openai", "anthropic", "ollama":
+			if m.Provider != "ollama" && m.APIKey == "" {
+				errs = append(errs, prefix+".api_key 不能为空（未填写时沿用 llm.api_key）")
+			}
+			if u, err := url.Parse(m.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, prefix+".base_url 必须是http(s)地址（未填写时沿用 llm.base_url）")
+			}
+		case "fake":
+		default:
+			errs = append(errs, fmt.Sprintf("%s 未知的模型后端 provider=%q（未填写时沿用 llm.provider）", prefix, m.Provider))
+		}
+		if m.ContextWindow < 0 || (m.ContextWindow > 0 && m.ContextWindow <= c.Context.ReserveTokens) {
+			errs = append(errs, prefix+".context_window 必须大于 context.reserve_tokens")
+		}
+	}
+	if c.LLM.Retry.MaxAttempts < 1 {
+		errs = append(errs, "llm.retry.max_attempts 至少为1")
+	}
+	if c.LLM.Retry.MaxDelay.Duration < c.LLM.Retry.BaseDelay.Duration {
+		errs = append(errs, "llm.retry.max_delay 不能小于 llm.retry.base_delay")
+	}
+	if c.LLM.Retry.AttemptTimeout.Duration < 0 {
+		errs = append(errs, "llm.retry.attempt_timeout 不能为负数")
+	}
+	if c.LLM.CircuitBreaker.FailureThreshold < 0 {
+		errs = append(errs, "llm.circuit_breaker.failure_threshold 不能为负数")
+	}
+	if c.Database.Driver != "mysql" && c.Database.Driver != "sqlite" {
+		errs = append(errs, fmt.Sprintf("未知的数据库类型 database.driver=%q", c.Database.Driver))
+	}
+	if c.Database.DSN == "" {
+		errs = append(errs, "database.dsn 不能为空")
+	}
+	if c.Upload.Dir == "" {
+		errs = append(errs, "upload.dir 不能为空")
+	}
+	if !strings.HasPrefix(c.Upload.URLPrefix, "/") || !strings.HasSuffix(c.Upload.URLPrefix, "/") {
+		errs = append(errs, "upload.url_prefix 必须以/开头和结尾")
+	}
+	if c.Upload.MaxBytes <= 0 || c.Upload.MaxPixels <= 0 {
+		errs = append(errs, "upload.max_bytes 和 upload.max_pixels 必须大于0")
+	}
+	if c.Upload.ThumbSize <= 0 || c.Upload.AvatarSize < c.Upload.ThumbSize || c.Upload.AvatarSize > 4096 {
+		errs = append(errs, "upload 的尺寸须满足 0 < thumb_size <= avatar_size <= 4096")
+	}
+	if c.Context.DefaultWindow <= 0 {
+		errs = append(errs, "context.default_window 必须大于0")
+	}
+	if c.Context.ReserveTokens < 0 || c.Context.ReserveTokens >= c.Context.DefaultWindow {
+		errs = append(errs, "context.reserve_tokens 必须小于 context.default_window")
+	}
+	if c.Context.KeepRecent < 1 {
+		errs = append(errs, "context.keep_recent 至少为1")
+	}
+	for name, w := range c.Context.Windows {
+		if w <= c.Context.ReserveTokens {
+			errs = append(errs, fmt.Sprintf("context.windows[%s] 必须大于 context.reserve_tokens", name))
+		}
+	}
+	for name, p := range c.Pricing.Models {
+		if p.Prompt < 0 || p.Completion < 0 {
+			errs = append(errs, fmt.Sprintf("pricing.models[%s] 的单价不能为负数", name))
+		}
+	}
+	for name, l := range map[string]LimitRule{"limits.user": c.Limits.User, "limits.session": c.Limits.Session} {
+		if l.RequestsPerMinute < 0 || l.DailyTokens < 0 || l.MonthlyTokens < 0 || l.DailyCost < 0 || l.MonthlyCost < 0 {
+			errs = append(errs, name+" 的各项限额不能为负数")
+		}
+	}
+	if c.Memory.Enabled && (c.Memory.KeepRecent < 0 || c.Memory.TriggerMessages <= c.Memory.KeepRecent) {
+		errs = append(errs, "memory.trigger_messages 必须大于 memory.keep_recent")
+	}
+	switch c.ExitIntent.Mode {
+	case exitIntentHybrid, exitIntentLocal, exitIntentLLM:
+	default:
+		errs = append(errs, fmt.Sprintf("未知的退出意图识别方式 exit_intent.mode=%q", c.ExitIntent.Mode))
+	}
+	if c.ExitIntent.StayThreshold < 0 || c.ExitIntent.ExitThreshold > 1 || c.ExitIntent.StayThreshold >= c.ExitIntent.ExitThreshold {
+		errs = append(errs, "exit_intent 的阈值须满足 0 <= stay_threshold < exit_threshold <= 1")
+	}
+	if c.Jobs.Workers < 1 {
+		errs = append(errs, "jobs.workers 至少为1")
+	}
+	if c.Jobs.MaxAttempts < 1 {
+		errs = append(errs, "jobs.max_attempts 至少为1")
+	}
+	if c.Jobs.Lease.Duration <= c.Timeouts.Summary.Duration || c.Jobs.Lease.Duration <= c.Timeouts.Title.Duration {
+		errs = append(errs, "jobs.lease 必须大于 timeouts.summary 和 timeouts.title")
+	}
+	timeouts := map[string]Duration{
+		"server.read_timeout":  c.Server.ReadTimeout,
+		"timeouts.chat":        c.Timeouts.Chat,
+		"timeouts.stream":      c.Timeouts.Stream,
+		"timeouts.exit_intent": c.Timeouts.ExitIntent,
+		"timeouts.title":       c.Timeouts.Title,
+		"timeouts.summary":     c.Timeouts.Summary,
+		"auth.session_ttl":     c.Auth.SessionTTL,
+
+		"llm.retry.base_delay":         c.LLM.Retry.BaseDelay,
+		"llm.circuit_breaker.cooldown": c.LLM.CircuitBreaker.Cooldown,
+		"jobs.poll_interval":           c.Jobs.PollInterval,
+		"jobs.retry_delay":             c.Jobs.RetryDelay,
+		"jobs.retention":               c.Jobs.Retention,
+	}
+	for name, d := range timeouts {
+		if d.Duration <= 0 {
+			errs = append(errs, name+" 必须大于0")
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("配置校验失败: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Redacted 返回脱敏后的YAML，用于启动日志和 -print-config
+func (c *Config) Redacted() string {
+	cp := *c
+	cp.LLM.APIKey = redactSecret(cp.LLM.APIKey)
+	cp.Models = make([]ModelConfig, len(c.Models))
+	for i, m := range c.Models {
+		m.APIKey = redactSecret(m.APIKey)
+		cp.Models[i] = m
+	}
+	cp.Database.DSN = redactDSN(cp.Database.DSN)
+	out, err := yaml.Marshal(&cp)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	if len(s) <= 8 {
+		return "****"
+	}
+	return s[:3] + "****" + s[len(s)-4:]
+}
+
+// redactDSN 隐去 user:password@... 中的密码
+func redactDSN(dsn string) string {
+	at := strings.LastIndex(dsn, "@")
+	if at == -1 {
+		return dsn
+	}
+	colon := strings.Index(dsn[:at], ":")
+	if colon == -1 {
+		return dsn
+	}
+	return dsn[:colon+1] + "****" + dsn[at:]
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateModelsWithoutTopLevelLLM(t *testing.T) {
+	c := defaultConfig()
+	c.Database.DSN = "user:pass@tcp(127.0.0.1:3306)/helios"
+	c.Models = []ModelConfig{
+		{Name: "gpt", Provider: "openai", BaseURL: "https://api.example.com/v1/chat/completions", APIKey: "k", Model: "gpt-4o"},
+		{Name: "local", Provider: "ollama", BaseURL: "http://127.0.0.1:11434/api/chat"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("每个模型都填写完整时不应要求llm: %v", err)
+	}
+
+	// 缺少的字段沿用llm，llm也没有时报在对应的模型上
+	c.Models = append(c.Models, ModelConfig{Name: "claude", Provider: "anthropic"})
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("models[2]缺少api_key和base_url应校验失败")
+	}
+	for _, want := range []string{"models[2].api_key", "models[2].base_url"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("错误中没有%s: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "llm.model 不能为空") {
+		t.Errorf("不应校验llm.model: %v", err)
+	}
+
+	c.LLM.APIKey, c.LLM.BaseURL = "k", "https://api.anthropic.com/v1/messages"
+	if err := c.Validate(); err != nil {
+		t.Errorf("沿用llm的地址和密钥后应通过: %v", err)
+	}
+}
+
+func TestValidateTopLevelLLM(t *testing.T) {
+	c := defaultConfig()
+	c.Database.DSN = "user:pass@tcp(127.0.0.1:3306)/helios"
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "llm.api_key") || !strings.Contains(err.Error(), "llm.model") {
+		t.Errorf("没有配置models时应校验llm: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// defaultContextWindows 常见模型的上下文长度（token），按名称前缀匹配，可在配置 context.windows 中覆盖
+var defaultContextWindows = map[string]int{
+	"deepseek":      65536,
+	"gpt-4o":        128000,
+	"gpt-4.1":       1047576,
+	"gpt-4-turbo":   128000,
+	"gpt-4":         8192,
+	"gpt-3.5-turbo": 16385,
+	"claude":        200000,
+	"qwen":          32768,
+	"llama3":        8192,
+	"glm-4":         128000,
+	"moonshot":      32768,
+}
+
+// messageOverheadTokens 每条消息除内容外的固定开销（角色、分隔符等）
+const messageOverheadTokens = 4
+
+// ContextBudget 某个模型可用于输入的token预算
+type ContextBudget struct {
+	Model         string `json:"model"`
+	ContextWindow int    `json:"contextWindow"`
+	ReserveTokens int    `json:"reserveTokens"`
+	Budget        int    `json:"budget"`
+}
+
+// ContextStats 一次上下文构建的结果统计
+type ContextStats struct {
+	ContextBudget
+	PromptTokens    int `json:"promptTokens"`
+	TotalMessages   int `json:"totalMessages"`
+	SentMessages    int `json:"sentMessages"`
+	DroppedMessages int `json:"droppedMessages"`
+}
+
+// contextWindowFor 取最长前缀匹配的上下文长度，配置中的同名前缀优先，未知模型使用配置的默认值
+func contextWindowFor(modelName string) int {
+	name := strings.ToLower(strings.TrimSpace(modelName))
+	best, window := -1, cfg.Context.DefaultWindow
+	for _, table := range []map[string]int{defaultContextWindows, cfg.Context.Windows} {
+		for prefix, w := range table {
+			p := strings.ToLower(prefix)
+			if strings.HasPrefix(name, p) && len(p) >= best {
+				best, window = len(p), w
+			}
+		}
+	}
+	return window
+}
+
+// budgetForSession 按会话实际使用的模型计算上下文预算
+func budgetForSession(session Session) ContextBudget {
+	m := modelFor(session)
+	name, window := m.Name, m.contextWindow()
+	budget := window - cfg.Context.ReserveTokens
+	if budget < 0 {
+		budget = 0
+	}
+	return ContextBudget{
+		Model:         name,
+		ContextWindow: window,
+		ReserveTokens: cfg.Context.ReserveTokens,
+		Budget:        budget,
+	}
+}
+
+// estimateTokens 粗略估算token数：中日韩字符约1个token，其余按约4个字符1个token
+func estimateTokens(s string) int {
+	cjk, other := 0, 0
+	for _, r := range s {
+		if unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r) {
+			cjk++
+		} else {
+			other++
+		}
+	}
+	return cjk + (other+3)/4
+}
+
+func estimateMessagesTokens(msgs []ChatMessage) int {
+	total := 0
+	for _, m := range msgs {
+		total += estimateTokens(m.Content) + messageOverheadTokens
+	}
+	return total
+}
+
+// fitContext 在预算内保留尽可能多的近期消息：开头的system消息（system prompt、滚动摘要）始终保留，
+// 末尾keepRecent条（至少包含本轮用户输入）也始终保留；超出预算时从最早的一轮开始整轮丢弃，
+// 并保证剩余历史以用户消息开头。返回发送的消息和被丢弃的消息
+func fitContext(msgs []ChatMessage, budget, keepRecent int) ([]ChatMessage, []ChatMessage) {
+	if len(msgs) <= 1 || estimateMessagesTokens(msgs) <= budget {
+		return msgs, nil
+	}
+	pinned := 0
+	for pinned < len(msgs) && msgs[pinned].Role == "system" {
+		pinned++
+	}
+	system, history := msgs[:pinned], msgs[pinned:]
+	if keepRecent < 1 {
+		keepRecent = 1
+	}
+	maxDrop := len(history) - keepRecent
+	if maxDrop <= 0 {
+		return msgs, nil
+	}
+
+	// 预先计入省略提示本身的开销
+	used := estimateMessagesTokens(msgs) + estimateTokens(omittedNote(len(history))) + messageOverheadTokens
+	drop := 0
+	for drop < maxDrop && used > budget {
+		used -= estimateTokens(history[drop].Content) + messageOverheadTokens
+		drop++
+	}
+	// 不以assistant消息开头，避免半轮对话
+	for drop < maxDrop && history[drop].Role != "user" {
+		drop++
+	}
+	if drop == 0 {
+		return msgs, nil
+	}
+	kept := make([]ChatMessage, 0, len(msgs)-drop+1)
+	kept = append(kept, system...)
+	kept = append(kept, ChatMessage{Role: "system", Content: omittedNote(drop)})
+	kept = append(kept, history[drop:]...)
+	return kept, history[:drop]
+}
+
+func omittedNote(n int) string {
+	return fmt.Sprintf("（为控制上下文长度，更早的%d条对话消息已省略）", n)
+}
+
+// contextStats 汇总构建结果，供日志和 /api/session/context 使用
+func contextStats(budget ContextBudget, all, sent []ChatMessage, dropped int) ContextStats {
+	return ContextStats{
+		ContextBudget:   budget,
+		PromptTokens:    estimateMessagesTokens(sent),
+		TotalMessages:   len(all),
+		SentMessages:    len(sent),
+		DroppedMessages: dropped,
+	}
+}
+
+// getSessionContext 查看会话当前的上下文预算与占用
+func getSessionContext(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("sessionId")
+	if sessionID == "" {
+		http.Error(w, "缺少sessionId参数", http.StatusBadRequest)
+		return
+	}
+	session, err := findSession(currentUserID(r), sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	history, err := loadChatHistory(session, session.HeadMessageID)
+	if err != nil {
+		http.Error(w, "获取历史消息失败", http.StatusInternalServerError)
+		return
+	}
+	budget := budgetForSession(session)
+	sent, dropped := fitContext(history, budget.Budget, cfg.Context.KeepRecent)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contextStats(budget, history, sent, len(dropped)))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// sqliteDefaultPragmas 未显式指定 _pragma 时使用：开启外键（级联删除/SET NULL依赖它）、
+// WAL以便后台写标题时不阻塞读、以及锁等待
+const sqliteDefaultPragmas = "_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+
+// sqliteTxLock 事务开始时就取写锁。默认的deferred事务先读后写时如果已有其他写者，
+// SQLite直接返回SQLITE_BUSY而不等待busy_timeout，后台任务和对话同时写入时会失败
+const sqliteTxLock = "_txlock=immediate"
+
+// openDatabase 按配置选择MySQL或SQLite（纯Go驱动，无需CGO）
+func openDatabase(c DatabaseConfig) (*gorm.DB, error) {
+	switch c.Driver {
+	case "", "mysql":
+		return gorm.Open(mysql.Open(c.DSN), &gorm.Config{})
+	case "sqlite":
+		dsn := c.DSN
+		for _, param := range []string{sqliteDefaultPragmas, sqliteTxLock} {
+			if strings.Contains(dsn, strings.SplitN(param, "=", 2)[0]+"=") {
+				continue
+			}
+			sep := "?"
+			if strings.Contains(dsn, "?") {
+				sep = "&"
+			}
+			dsn += sep + param
+		}
+		if file := strings.TrimPrefix(strings.SplitN(c.DSN, "?", 2)[0], "file:"); file != "" && file != ":memory:" {
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				return nil, err
+			}
+		}
+		return gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	}
+	return nil, fmt.Errorf("未知的数据库类型: %s", c.Driver)
+}
+
+// migrate 建表并补齐外键，语义与 static/create.sql 一致：
+// 删除会话级联删除消息，删除人格时会话的persona_id置空
+func migrate(db *gorm.DB) error {
+	if err := cleanDanglingRefs(db); err != nil {
+		return err
+	}
+	if err := db.AutoMigrate(&User{}, &LoginSession{}, &Persona{}, &PersonaRevision{}, &Session{}, &Message{}, &SessionSummary{}, &SessionMember{}, &UsageRecord{}, &Job{}); err != nil {
+		return err
+	}
+	if err := backfillMessageTree(db); err != nil {
+		return err
+	}
+	if err := backfillPersonaRevisions(db); err != nil {
+		return err
+	}
+	return setupFullText(db)
+}
+
+// cleanDanglingRefs 早期版本没有外键约束，可能留下指向已删除记录的数据，
+// 不清理的话MySQL上无法补建外键
+func cleanDanglingRefs(db *gorm.DB) error {
+	m := db.Migrator()
+	if m.HasTable(&Session{}) && m.HasTable(&Persona{}) {
+		if err := db.Exec("UPDATE sessions SET persona_id = NULL WHERE persona_id IS NOT NULL AND persona_id NOT IN (SELECT id FROM personas)").Error; err != nil {
+			return err
+		}
+	}
+	if m.HasTable(&Message{}) && m.HasTable(&Session{}) {
+		if err := db.Exec("DELETE FROM messages WHERE session_id NOT IN (SELECT id FROM sessions)").Error; err != nil {
+			return err
+		}
+	}
+	if m.HasTable(&SessionSummary{}) && m.HasTable(&Session{}) {
+		if err := db.Exec("DELETE FROM session_summaries WHERE session_id NOT IN (SELECT id FROM sessions)").Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 会话列表和人格的变化通过 GET /api/events（SSE）推送给该用户所有打开的页面，
+// 例如后台任务生成标题后页面无需轮询即可更新。事件只在本进程内分发，不做持久化：
+// 客户端每次（重新）连接后应先重新加载一次列表
+
+// 事件类型
+const (
+	eventSessionCreated    = "session.created"
+	eventSessionRenamed    = "session.renamed"
+	eventSessionTerminated = "session.terminated"
+	eventSessionReopened   = "session.reopened"
+	eventSessionDeleted    = "session.deleted"
+	eventSessionUpdated    = "session.updated" // 群聊成员或会话使用的人格变化
+	eventPersonaChanged    = "persona.changed" // 新建、修改、导入或回滚
+	eventPersonaDeleted    = "persona.deleted"
+)
+
+const (
+	eventBuffer        = 32               // 每个连接缓冲的事件数，处理不过来时断开，由客户端重连后重新加载
+	maxEventConns      = 8                // 每个用户同时打开的事件流上限
+	eventHeartbeat     = 25 * time.Second // 心跳间隔，防止代理因空闲断开连接
+	eventStreamRefresh = time.Hour        // 连接最长保持时间，到期后由客户端重连
+)
+
+// Event 推送给客户端的事件，Type同时作为SSE的event名
+type Event struct {
+	Type      string `json:"type"`
+	SessionID string `json:"sessionId,omitempty"`
+	PersonaID uint   `json:"personaId,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[uint]map[chan Event]struct{}
+}
+
+var events = &eventHub{subs: map[uint]map[chan Event]struct{}{}}
+
+// subscribe 超过连接上限时返回nil
+func (h *eventHub) subscribe(userID uint) chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs[userID]) >= maxEventConns {
+		return nil
+	}
+	ch := make(chan Event, eventBuffer)
+	if h.subs[userID] == nil {
+		h.subs[userID] = map[chan Event]struct{}{}
+	}
+	h.subs[userID][ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(userID uint, ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[userID][ch]; ok {
+		delete(h.subs[userID], ch)
+		close(ch)
+	}
+	if len(h.subs[userID]) == 0 {
+		delete(h.subs, userID)
+	}
+}
+
+// publish 不阻塞调用方；缓冲已满的连接直接关闭
+func (h *eventHub) publish(userID uint, ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[userID] {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs[userID], ch)
+			close(ch)
+		}
+	}
+}
+
+// publishEvent 会话和人格的UserID可能为空（旧数据），此时没有可推送的对象
+func publishEvent(userID *uint, ev Event) {
+	if userID != nil {
+		events.publish(*userID, ev)
+	}
+}
+
+// handleEvents 当前用户的事件流
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	userID := currentUserID(r)
+	ch := events.subscribe(userID)
+	if ch == nil {
+		http.Error(w, "打开的页面过多", http.StatusTooManyRequests)
+		return
+	}
+	defer events.unsubscribe(userID, ch)
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "不支持流式输出", http.StatusInternalServerError)
+		return
+	}
+	// 告诉EventSource断线后的重连间隔
+	fmt.Fprint(w, "retry: 3000\n\n")
+	sse.flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	refresh := time.NewTimer(eventStreamRefresh)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-refresh.C:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			sse.flusher.Flush()
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := sse.send(ev.Type, ev); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// 退出意图先由本地分类器打分：关键词规则覆盖常见的中英日告别语、挽留和“怎么退出”之类的提问，
+// 配置了标注语料时再用朴素贝叶斯模型给规则无法确定的消息打分。得分不低于exit_threshold直接终止，
+// 不高于stay_threshold直接继续，介于两者之间的才交给模型判断（mode=hybrid）
+
+const (
+	exitIntentHybrid = "hybrid" // 本地无法确定时调用模型
+	exitIntentLocal  = "local"  // 只用本地分类器，无法确定时视为继续对话
+	exitIntentLLM    = "llm"    // 每条消息都调用模型
+)
+
+// exitVerdict 本地分类的结论
+type exitVerdict int
+
+const (
+	exitUnsure exitVerdict = iota
+	exitYes
+	exitNo
+)
+
+// 规则得分
+const (
+	scoreStrongExit = 0.95 // 消息基本只有告别语
+	scoreWeakExit   = 0.6  // 告别语夹在较长的话里，或是“困了”“去忙了”这类暗示
+	scoreStay       = 0.05 // 挽留、询问怎么退出等明确不是要结束
+	scoreNoMatch    = 0.1  // 没有任何线索
+)
+
+var (
+	// exitPhrases 明确的告别语
+	exitPhrases = regexp.MustCompile(`(?i)再见|拜拜|拜了|白白|告辞|晚安|溜了|下线了?|退出|结束(对话|聊天|会话|吧|了)|不聊了|不想聊了|别聊了|聊到这(里|儿)?|就到这(里|儿)|先这样(吧|了)|下次(再)?聊|回头(再)?聊|改天(再)?聊|明天(再)?聊|\b88+6?\b|` +
+		`\b(good ?bye|bye( ?bye)?|see (you|ya)|cya|farewell|quit|exit|good ?night|gotta go|got to go|i have to go|i need to go|gtg|ttyl|talk (to you )?(later|soon|tomorrow)|end (the |this )?(chat|conversation)|stop (chatting|talking)|i'?m done|that'?s all)\b|` +
+		`さようなら|さよなら|またね|じゃあね|バイバイ|おやすみ|失礼します`)
+	// weakExitPhrases 暗示要离开，需要结合上下文
+	weakExitPhrases = regexp.MustCompile(`(?i)走了|去忙了?|先忙|睡了|去睡|睡觉了|困了|有事|先撤|\b(later|leaving|gotta run|heading out|going to bed|off to bed)\b|寝ます|行ってきます`)
+	// stayPhrases 挽留、否定或继续，优先于告别语
+	stayPhrases = regexp.MustCompile(`(?i)别走|不要走|不走|别结束|不要结束|不想结束|不结束|不退出|不要退出|别退出|继续聊|接着聊|再聊(一会|一下|聊)|还没聊完|` +
+		`\b(don'?t (go|leave|quit|exit|end)|not (leaving|done|going)|keep (talking|going|chatting)|continue|let'?s continue)\b|` +
+		`行かないで|まだ話`)
+	// metaPhrases 关于告别语或退出操作本身的提问，如“再见用英语怎么说”“vim怎么退出”
+	metaPhrases = regexp.MustCompile(`(?i)(怎么|如何|怎样|咋)(样)?(退出|结束|说|写|读|翻译)|怎么说|什么意思|翻译|歌词|` +
+		`\b(how (do|can|to) (i |you )?(exit|quit|say|end)|what does|translate|meaning of|exit code|quit smoking)\b|` +
+		`どうやって|意味`)
+	// fillers 计算告别语之外的剩余内容时忽略的语气词、客套话
+	fillers = regexp.MustCompile(`(?i)好的|好吧|好啦|好|嗯+|那+|那么|我要|我先|我|先|就|今天|了|啦|吧|呀|哦|哈+|咯|喽|啊|谢谢(你)?|感谢|多谢|朋友|大家|` +
+		`\b(ok(ay)?|thanks?( you)?|for now|then|well|all|now|everyone|guys|so|alright|right|bye|and|i|am|m|the|later|soon)\b|` +
+		`ありがとう|では|じゃ`)
+)
+
+// maxFillerRunes 去掉告别语和语气词后剩余不超过该字数的，视为只是在告别
+const maxFillerRunes = 4
+
+// ruleScore 规则打分，第二个返回值表示规则是否有把握；没有把握时交给打分模型
+func ruleScore(text string) (float64, bool) {
+	t := strings.ToLower(strings.TrimSpace(text))
+	if t == "" {
+		return scoreNoMatch, true
+	}
+	if stayPhrases.MatchString(t) || metaPhrases.MatchString(t) {
+		return scoreStay, true
+	}
+	if exitPhrases.MatchString(t) {
+		if !isQuestion(t) && remainingRunes(exitPhrases.ReplaceAllString(t, " ")) <= maxFillerRunes {
+			return scoreStrongExit, true
+		}
+		return scoreWeakExit, false
+	}
+	if weakExitPhrases.MatchString(t) {
+		return scoreWeakExit, false
+	}
+	return scoreNoMatch, false
+}
+
+// isQuestion 问句中的告别语多半是在谈论它，如“你会说再见吗”
+func isQuestion(t string) bool {
+	t = strings.TrimRightFunc(t, func(r rune) bool { return unicode.IsSpace(r) || r == '!' || r == '！' })
+	return strings.HasSuffix(t, "?") || strings.HasSuffix(t, "？") || strings.HasSuffix(t, "吗") || strings.HasSuffix(t, "か")
+}
+
+// remainingRunes 去掉语气词、标点、空白和表情后剩下的字数
+func remainingRunes(s string) int {
+	s = fillers.ReplaceAllString(s, " ")
+	n := 0
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// exitFeatures 拉丁字母按单词、其余文字按单字和相邻两字切分
+func exitFeatures(text string) []string {
+	var feats, word []string
+	var prev rune
+	flush := func() {
+		if len(word) > 0 {
+			feats = append(feats, "w:"+strings.Join(word, ""))
+			word = word[:0]
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\''):
+			word = append(word, string(r))
+			prev = 0
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flush()
+			feats = append(feats, "c:"+string(r))
+			if prev != 0 {
+				feats = append(feats, "b:"+string(prev)+string(r))
+			}
+			prev = r
+		default:
+			flush()
+			prev = 0
+		}
+	}
+	flush()
+	return feats
+}
+
+// naiveBayes 二分类的多项式朴素贝叶斯，用加一平滑
+type naiveBayes struct {
+	counts [2]map[string]float64
+	totals [2]float64
+	docs   [2]float64
+	vocab  map[string]bool
+}
+
+// LabeledUtterance 标注语料的一行，JSON Lines格式
+type LabeledUtterance struct {
+	Text string `json:"text"`
+	Exit bool   `json:"exit"`
+}
+
+func readLabeledUtterances(path string) ([]LabeledUtterance, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []LabeledUtterance
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		var u LabeledUtterance
+		if err := json.Unmarshal([]byte(s), &u); err != nil {
+			return nil, fmt.Errorf("第%d行格式错误: %v", line, err)
+		}
+		out = append(out, u)
+	}
+	return out, sc.Err()
+}
+
+func trainNaiveBayes(data []LabeledUtterance) (*naiveBayes, error) {
+	nb := &naiveBayes{
+		counts: [2]map[string]float64{{}, {}},
+		vocab:  map[string]bool{},
+	}
+	for _, u := range data {
+		c := 0
+		if u.Exit {
+			c = 1
+		}
+		nb.docs[c]++
+		for _, f := range exitFeatures(u.Text) {
+			nb.counts[c][f]++
+			nb.totals[c]++
+			nb.vocab[f] = true
+		}
+	}
+	if nb.docs[0] == 0 || nb.docs[1] == 0 {
+		return nil, fmt.Errorf("语料需要同时包含退出和非退出的样本")
+	}
+	return nb, nil
+}
+
+// prob 属于退出一类的概率，语料中没出现过的特征忽略
+func (nb *naiveBayes) prob(text string) float64 {
+	v := float64(len(nb.vocab))
+	logit := math.Log(nb.docs[1]) - math.Log(nb.docs[0])
+	for _, f := range exitFeatures(text) {
+		if !nb.vocab[f] {
+			continue
+		}
+		logit += math.Log((nb.counts[1][f]+1)/(nb.totals[1]+v)) - math.Log((nb.counts[0][f]+1)/(nb.totals[0]+v))
+	}
+	return 1 / (1 + math.Exp(-logit))
+}
+
+// exitClassifier 本地退出意图分类器
+type exitClassifier struct {
+	conf  ExitIntentConfig
+	model *naiveBayes
+}
+
+var exitIntent = &exitClassifier{conf: defaultConfig().ExitIntent}
+
+// initExitClassifier 按配置加载语料并训练打分模型
+func initExitClassifier(c *Config) error {
+	ec := &exitClassifier{conf: c.ExitIntent}
+	if c.ExitIntent.ModelFile != "" {
+		data, err := readLabeledUtterances(c.ExitIntent.ModelFile)
+		if err != nil {
+			return fmt.Errorf("读取退出意图语料%s失败: %v", c.ExitIntent.ModelFile, err)
+		}
+		if ec.model, err = trainNaiveBayes(data); err != nil {
+			return fmt.Errorf("退出意图语料%s: %v", c.ExitIntent.ModelFile, err)
+		}
+	}
+	exitIntent = ec
+	return nil
+}
+
+// score 规则有把握时以规则为准，否则有模型时用模型的概率。
+// 没有任何规则线索的消息，模型认为不是退出时按普通消息处理，避免大量消息落入需要调用模型的区间；
+// 模型认为是退出时也只当作弱线索交给模型复核，语料不大时模型单独给出的高分并不可靠
+func (c *exitClassifier) score(text string) float64 {
+	s, sure := ruleScore(text)
+	if sure || c.model == nil {
+		return s
+	}
+	p := c.model.prob(text)
+	if s == scoreNoMatch {
+		if p >= c.conf.ExitThreshold {
+			return scoreWeakExit
+		}
+		return s
+	}
+	return p
+}
+
+// classify mode=llm时总是无法确定，mode=local时把无法确定的视为继续对话
+func (c *exitClassifier) classify(text string) (exitVerdict, float64) {
+	if c.conf.Mode == exitIntentLLM {
+		return exitUnsure, 0
+	}
+	s := c.score(text)
+	switch {
+	case s >= c.conf.ExitThreshold:
+		return exitYes, s
+	case s <= c.conf.StayThreshold:
+		return exitNo, s
+	case c.conf.Mode == exitIntentLocal:
+		return exitNo, s
+	}
+	return exitUnsure, s
+}
+
+// evalExitIntent 用标注语料评估本地分类器，输出判错和交给模型的样本、准确率和需要调用模型的比例
+func evalExitIntent(path string, out io.Writer) error {
+	data, err := readLabeledUtterances(path)
+	if err != nil {
+		return err
+	}
+	r := exitIntent.evaluate(data, func(label string, score float64, text string) {
+		fmt.Fprintf(out, "%s %.2f  %s\n", label, score, text)
+	})
+	fmt.Fprintf(out, "\n样本 %d 条，本地判定 %d 条，交给模型 %d 条（%.1f%%，其中退出 %d 条）\n",
+		r.total(), r.decided(), r.Unsure, percent(r.Unsure, r.total()), r.UnsureExit)
+	fmt.Fprintf(out, "本地判定：退出 正确%d 错误%d，继续 正确%d 错误%d\n", r.TP, r.FP, r.TN, r.FN)
+	fmt.Fprintf(out, "准确率 %.1f%%  退出精确率 %.1f%%  退出召回率 %.1f%%\n",
+		percent(r.TP+r.TN, r.decided()), percent(r.TP, r.TP+r.FP), percent(r.TP, r.TP+r.FN))
+	return nil
+}
+
+// exitEvalResult 在标注语料上的判定结果，FP/FN为本地判定出错的条数
+type exitEvalResult struct {
+	TP, FP, TN, FN     int
+	Unsure, UnsureExit int
+}
+
+func (r exitEvalResult) decided() int { return r.TP + r.FP + r.TN + r.FN }
+func (r exitEvalResult) total() int   { return r.decided() + r.Unsure }
+
+// evaluate 对每条语料分类并统计；交给模型和判错的样本通过report输出
+func (c *exitClassifier) evaluate(data []LabeledUtterance, report func(label string, score float64, text string)) exitEvalResult {
+	var r exitEvalResult
+	for _, u := range data {
+		v, s := c.classify(u.Text)
+		switch {
+		case v == exitUnsure:
+			report("交给模型  ", s, u.Text)
+			r.Unsure++
+			if u.Exit {
+				r.UnsureExit++
+			}
+		case v == exitYes && u.Exit:
+			r.TP++
+		case v == exitYes:
+			r.FP++
+			report("误判为退出", s, u.Text)
+		case u.Exit:
+			r.FN++
+			report("漏判退出  ", s, u.Text)
+		default:
+			r.TN++
+		}
+	}
+	return r
+}
+
+func percent(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) * 100 / float64(b)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+// exitIntentCorpus 标注语料，与 -eval-exit-intent 使用的是同一份
+const exitIntentCorpus = "testdata/exit_intent.jsonl"
+
+// 本地判定的下限：交给模型的消息不算判对
+const (
+	minExitAccuracy   = 0.85 // 本地判对的条数占全部样本的比例
+	maxExitUnsureRate = 0.15 // 交给模型判断的比例
+)
+
+func loadExitCorpus(t *testing.T) []LabeledUtterance {
+	t.Helper()
+	data, err := readLabeledUtterances(exitIntentCorpus)
+	if err != nil {
+		t.Fatalf("读取%s失败: %v", exitIntentCorpus, err)
+	}
+	if len(data) == 0 {
+		t.Fatalf("%s没有样本", exitIntentCorpus)
+	}
+	return data
+}
+
+// checkExitEval 本地判定不能出错，准确率和交给模型的比例在限度内
+func checkExitEval(t *testing.T, c *exitClassifier, data []LabeledUtterance, minAccuracy, maxUnsure float64) {
+	t.Helper()
+	r := c.evaluate(data, func(label string, score float64, text string) {
+		t.Logf("%s %.2f  %s", label, score, text)
+	})
+	if r.FP+r.FN > 0 {
+		t.Errorf("本地判定出错：误判为退出%d条，漏判退出%d条", r.FP, r.FN)
+	}
+	if acc := float64(r.TP+r.TN) / float64(r.total()); acc < minAccuracy {
+		t.Errorf("准确率%.3f低于%.2f", acc, minAccuracy)
+	}
+	if rate := float64(r.Unsure) / float64(r.total()); rate > maxUnsure {
+		t.Errorf("交给模型的比例%.3f超过%.2f", rate, maxUnsure)
+	}
+}
+
+func TestExitIntentRules(t *testing.T) {
+	c := &exitClassifier{conf: defaultConfig().ExitIntent}
+	checkExitEval(t, c, loadExitCorpus(t), minExitAccuracy, maxExitUnsureRate)
+}
+
+// TestExitIntentNaiveBayes 用一半语料训练，在另一半上评估，避免用训练数据评估自己
+func TestExitIntentNaiveBayes(t *testing.T) {
+	data := loadExitCorpus(t)
+	var train, held []LabeledUtterance
+	for i, u := range data {
+		if i%2 == 0 {
+			train = append(train, u)
+		} else {
+			held = append(held, u)
+		}
+	}
+	model, err := trainNaiveBayes(train)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &exitClassifier{conf: defaultConfig().ExitIntent, model: model}
+	checkExitEval(t, c, held, minExitAccuracy, maxExitUnsureRate)
+}
+
+func TestExitIntentModes(t *testing.T) {
+	cases := []struct {
+		mode, text string
+		want       exitVerdict
+	}{
+		{exitIntentHybrid, "再见", exitYes},
+		{exitIntentHybrid, "今天天气怎么样", exitNo},
+		{exitIntentHybrid, "有事先走了", exitUnsure},
+		// 问的是告别语本身
+		{exitIntentHybrid, "再见用英语怎么说？", exitNo},
+		{exitIntentLocal, "有事先走了", exitNo},
+		{exitIntentLocal, "再见", exitYes},
+		{exitIntentLLM, "再见", exitUnsure},
+	}
+	for _, tc := range cases {
+		conf := defaultConfig().ExitIntent
+		conf.Mode = tc.mode
+		c := &exitClassifier{conf: conf}
+		if got, s := c.classify(tc.text); got != tc.want {
+			t.Errorf("mode=%s %q: 得到%d（%.2f），期望%d", tc.mode, tc.text, got, s, tc.want)
+		}
+	}
+}
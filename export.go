@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sessionArchive JSON导出中的单个会话：会话本身、整棵消息树、全部摘要版本和关联的人格
+type sessionArchive struct {
+	Session
+	Persona   *Persona         `json:"persona,omitempty"`
+	Summaries []SessionSummary `json:"summaries"`
+}
+
+// isSyntheticMessage 会话结束时自动写入的结束提示和总结，不属于真实对话
+func isSyntheticMessage(m Message) bool {
+	return (m.Role == "system" && m.Content == sessionEndedText) || (m.Role == "assistant" && m.Meta == summaryMeta)
+}
+
+// exportSessions 导出一个或多个会话：format=markdown / json / jsonl，
+// sessionId 可重复或用逗号分隔，不传时导出当前用户的全部会话
+func exportSessions(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "markdown"
+	}
+	var ids []string
+	for _, v := range r.URL.Query()["sessionId"] {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	query := db.Where("user_id = ?", currentUserID(r)).Order("created_at asc")
+	if len(ids) > 0 {
+		query = query.Where("id IN ?", ids)
+	}
+	var sessions []Session
+	if err := query.Find(&sessions).Error; err != nil {
+		http.Error(w, "获取会话失败", http.StatusInternalServerError)
+		return
+	}
+	if len(ids) > 0 && len(sessions) != len(uniqueStrings(ids)) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	var ext, contentType string
+	var write func(io.Writer, []Session) error
+	switch format {
+	case "markdown", "md":
+		ext, contentType, write = "md", "text/markdown; charset=utf-8", writeMarkdownExport
+	case "json":
+		ext, contentType, write = "json", "application/json", writeJSONExport
+	case "jsonl":
+		ext, contentType, write = "jsonl", "application/x-ndjson", writeFineTuneExport
+	default:
+		http.Error(w, "不支持的导出格式", http.StatusBadRequest)
+		return
+	}
+
+	// 先写入缓冲，出错时还能返回500
+	var buf strings.Builder
+	if err := write(&buf, sessions); err != nil {
+		http.Error(w, "导出失败", http.StatusInternalServerError)
+		return
+	}
+	name := fmt.Sprintf("helios-export-%s.%s", time.Now().Format("20060102-150405"), ext)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	io.WriteString(w, buf.String())
+}
+
+func uniqueStrings(list []string) []string {
+	seen := make(map[string]bool, len(list))
+	var out []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// writeMarkdownExport 当前分支的对话记录，附带AI名称头像、滚动摘要和结束总结
+func writeMarkdownExport(w io.Writer, sessions []Session) error {
+	bw := bufio.NewWriter(w)
+	for i, s := range sessions {
+		if i > 0 {
+			fmt.Fprint(bw, "\n---\n\n")
+		}
+		path, err := activePath(s)
+		if err != nil {
+			return err
+		}
+		status := "进行中"
+		if s.Terminated {
+			status = "已结束"
+		}
+		fmt.Fprintf(bw, "# %s\n\n", s.Name)
+		fmt.Fprintf(bw, "![%s](%s) **%s**\n\n", s.AIName, s.AIAvatar, s.AIName)
+		fmt.Fprintf(bw, "- 模型：%s\n- 创建时间：%s\n- 状态：%s\n\n", s.Model, s.CreatedAt.Format("2006-01-02 15:04:05"), status)
+
+		if summary, _ := summaryOnPath(s.ID, path); summary != nil {
+			fmt.Fprintf(bw, "## 对话摘要\n\n（覆盖前%d条消息）\n\n%s\n\n", summary.MessageCount, quoteMarkdown(summary.Content))
+		}
+
+		fmt.Fprint(bw, "## 对话记录\n\n")
+		var final string
+		for _, m := range path {
+			if isSyntheticMessage(m) {
+				if m.Role == "assistant" {
+					final = m.Content
+				}
+				continue
+			}
+			switch m.Role {
+			case "system":
+				fmt.Fprintf(bw, "**设定**\n\n%s\n\n", quoteMarkdown(m.Content))
+			case "user":
+				fmt.Fprintf(bw, "### 用户 · %s\n\n%s\n\n", m.CreatedAt.Format("15:04:05"), m.Content)
+			case "assistant":
+				name := s.AIName
+				if m.Speaker != "" {
+					name = m.Speaker
+				}
+				fmt.Fprintf(bw, "### %s · %s\n\n%s\n\n", name, m.CreatedAt.Format("15:04:05"), m.Content)
+				if m.Meta != "" {
+					fmt.Fprintf(bw, "_%s_\n\n", m.Meta)
+				}
+			}
+		}
+		if final != "" {
+			fmt.Fprintf(bw, "## 对话总结\n\n%s\n\n", final)
+		}
+	}
+	return bw.Flush()
+}
+
+func quoteMarkdown(s string) string {
+	return "> " + strings.ReplaceAll(strings.TrimSpace(s), "\n", "\n> ")
+}
+
+// writeJSONExport 完整归档：包含所有分支上的消息，可用于备份或迁移
+func writeJSONExport(w io.Writer, sessions []Session) error {
+	archives := make([]sessionArchive, 0, len(sessions))
+	for _, s := range sessions {
+		a := sessionArchive{Session: s}
+		if err := db.Where("session_id = ?", s.ID).Order("id asc").Find(&a.Messages).Error; err != nil {
+			return err
+		}
+		if err := db.Where("session_id = ?", s.ID).Order("up_to_message_id asc").Find(&a.Summaries).Error; err != nil {
+			return err
+		}
+		if s.PersonaID != nil {
+			var p Persona
+			if err := db.First(&p, *s.PersonaID).Error; err == nil {
+				a.Persona = &p
+			}
+		}
+		archives = append(archives, a)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{
+		"version":     1,
+		"exported_at": time.Now(),
+		"sessions":    archives,
+	})
+}
+
+// writeFineTuneExport OpenAI对话微调格式，每个会话一行，只取当前分支上的system/user/assistant消息；
+// 不以助手回复结尾的部分和没有回复的会话会被跳过
+func writeFineTuneExport(w io.Writer, sessions []Session) error {
+	enc := json.NewEncoder(w)
+	for _, s := range sessions {
+		path, err := activePath(s)
+		if err != nil {
+			return err
+		}
+		var msgs []ChatMessage
+		hasUser := false
+		for _, m := range path {
+			if isSyntheticMessage(m) || m.Content == "" {
+				continue
+			}
+			switch m.Role {
+			case "user":
+				hasUser = true
+				fallthrough
+			case "system", "assistant":
+				msgs = append(msgs, ChatMessage{Role: m.Role, Content: m.Content})
+			}
+		}
+		for len(msgs) > 0 && msgs[len(msgs)-1].Role != "assistant" {
+			msgs = msgs[:len(msgs)-1]
+		}
+		if !hasUser || len(msgs) == 0 {
+			continue
+		}
+		if err := enc.Encode(map[string]interface{}{"messages": msgs}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// 群聊：一个会话中有多个人格成员，每轮按会话的TurnMode决定由谁回复。
+// 回复以发言成员的身份生成，system prompt、生成参数和用量都按该人格计算；
+// 在它的上下文里，自己的发言是assistant，用户和其他成员的发言以“名字：内容”作为user消息
+
+// 发言顺序
+const (
+	turnRoundRobin = "round_robin" // 按成员顺序轮流
+	turnAddressed  = "addressed"   // 用户消息中点名（@名字或直接提到名字）的成员回复，没有点名时轮流
+	turnModel      = "model"       // 由模型根据最近的对话挑选，失败时轮流
+)
+
+// speakerContextMessages 模型挑选发言人时参考的最近消息条数
+const speakerContextMessages = 10
+
+// SessionMember 群聊成员，Position为轮流发言的顺序；删除人格时同时退出群聊
+type SessionMember struct {
+	ID        uint     `gorm:"primaryKey;size:32" json:"id"`
+	SessionID string   `gorm:"type:varchar(64);index" json:"session_id"`
+	PersonaID uint     `gorm:"size:32;index" json:"persona_id"`
+	Persona   *Persona `gorm:"foreignKey:PersonaID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+	Position  int      `json:"position"`
+	// RevisionID 成员固定使用的人格版本
+	RevisionID *uint `gorm:"size:32" json:"revision_id"`
+}
+
+// groupMember 群聊成员在所固定版本下的人格
+type groupMember struct {
+	Persona
+	RevisionID *uint
+}
+
+type GroupMembersRequest struct {
+	SessionID  string `json:"sessionId"`
+	PersonaIDs []uint `json:"personaIds"`
+	TurnMode   string `json:"turnMode"`
+}
+
+func isGroup(session Session) bool {
+	return session.TurnMode != ""
+}
+
+// normalizeTurnMode 为空时默认轮流
+func normalizeTurnMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return turnRoundRobin, nil
+	case turnRoundRobin, turnAddressed, turnModel:
+		return mode, nil
+	}
+	return "", fmt.Errorf("turnMode只能是%s、%s或%s", turnRoundRobin, turnAddressed, turnModel)
+}
+
+// loadGroupPersonas 按给定顺序读取当前用户的人格，重复的ID只取一次；群聊至少需要两个成员
+func loadGroupPersonas(userID uint, ids []uint) ([]Persona, error) {
+	var personas []Persona
+	seen := make(map[uint]bool)
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		var p Persona
+		if err := db.Where("user_id = ?", userID).First(&p, id).Error; err != nil {
+			return nil, fmt.Errorf("人格%d不存在", id)
+		}
+		personas = append(personas, p)
+	}
+	if len(personas) < 2 {
+		return nil, errors.New("群聊至少需要两个不同的人格")
+	}
+	return personas, nil
+}
+
+// replaceGroupMembers 用personas替换会话的成员列表。原有成员保留所固定的版本，
+// 新加入或换成其他人格的成员固定在该人格的最新版本
+func replaceGroupMembers(tx *gorm.DB, sessionID string, personas []Persona) error {
+	var existing []SessionMember
+	if err := tx.Where("session_id = ?", sessionID).Find(&existing).Error; err != nil {
+		return err
+	}
+	pinned := make(map[uint]*uint, len(existing))
+	for _, m := range existing {
+		pinned[m.PersonaID] = m.RevisionID
+	}
+	if err := tx.Where("session_id = ?", sessionID).Delete(&SessionMember{}).Error; err != nil {
+		return err
+	}
+	for i, p := range personas {
+		revID, ok := pinned[p.ID]
+		if !ok || revID == nil {
+			var err error
+			if revID, err = latestRevisionID(tx, p.ID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&SessionMember{SessionID: sessionID, PersonaID: p.ID, Position: i, RevisionID: revID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupDisplay 群聊在会话列表和导出中显示的名称与头像：成员名用顿号连接，头像取第一个成员的
+func groupDisplay(personas []Persona) (string, string) {
+	names := make([]string, len(personas))
+	for i, p := range personas {
+		names[i] = p.Name
+	}
+	avatar := personas[0].Avatar
+	if avatar == "" {
+		avatar = "/static/ai_avatar.png"
+	}
+	return truncateRunes(strings.Join(names, "、"), 64), avatar
+}
+
+// groupMembers 按发言顺序返回群聊成员固定版本的人格
+func groupMembers(sessionID string) ([]groupMember, error) {
+	var rows []SessionMember
+	if err := db.Where("session_id = ?", sessionID).Order("position asc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	var members []groupMember
+	for _, m := range rows {
+		p, err := resolvePersona(m.PersonaID, m.RevisionID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, groupMember{Persona: p, RevisionID: m.RevisionID})
+	}
+	return members, nil
+}
+
+// memberNames 成员名称列表
+func memberNames(members []groupMember) []string {
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.Name
+	}
+	return names
+}
+
+// asSpeaker 以某个成员的身份调用模型时使用的会话副本，只在内存中使用，不写回数据库
+func asSpeaker(session Session, p groupMember) Session {
+	session.PersonaID = &p.ID
+	session.PersonaRevisionID = p.RevisionID
+	session.Personality = p.Personality
+	session.AIName = p.Name
+	session.AIAvatar = p.Avatar
+	if session.AIAvatar == "" {
+		session.AIAvatar = "/static/ai_avatar.png"
+	}
+	return session
+}
+
+// checkSpeaker 校验请求指定的回复成员，失败时已写出错误响应
+func checkSpeaker(w http.ResponseWriter, session Session, speakerID *uint) bool {
+	if speakerID == nil {
+		return true
+	}
+	if !isGroup(session) {
+		http.Error(w, "只有群聊可以指定回复的成员", http.StatusBadRequest)
+		return false
+	}
+	var n int64
+	db.Model(&SessionMember{}).Where("session_id = ? AND persona_id = ?", session.ID, *speakerID).Count(&n)
+	if n == 0 {
+		http.Error(w, "该人格不是群聊成员", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// speakerSession 群聊中选出本轮回复的成员并返回以其身份调用用的会话；非群聊原样返回。
+// requested为指定的成员，已不在群聊中时按发言顺序重新选择
+func speakerSession(session Session, leafID *uint, userInput string, requested *uint) (Session, error) {
+	if !isGroup(session) {
+		return session, nil
+	}
+	members, err := groupMembers(session.ID)
+	if err != nil {
+		return session, err
+	}
+	if len(members) == 0 {
+		return session, errors.New("群聊没有可以发言的成员")
+	}
+	if requested != nil {
+		for _, p := range members {
+			if p.ID == *requested {
+				return asSpeaker(session, p), nil
+			}
+		}
+	}
+	path, err := pathTo(session.ID, leafID)
+	if err != nil {
+		return session, err
+	}
+	var speaker *groupMember
+	switch session.TurnMode {
+	case turnAddressed:
+		speaker = addressedSpeaker(members, userInput)
+	case turnModel:
+		speaker = modelChosenSpeaker(session, members, path, userInput)
+	}
+	if speaker == nil {
+		speaker = nextInTurn(members, path)
+	}
+	return asSpeaker(session, *speaker), nil
+}
+
+// nextInTurn 分支上最后一个发言成员的下一位，还没有成员发言时从第一位开始
+func nextInTurn(members []groupMember, path []Message) *groupMember {
+	for i := len(path) - 1; i >= 0; i-- {
+		m := path[i]
+		if m.Role != "assistant" || m.PersonaID == nil {
+			continue
+		}
+		for j, p := range members {
+			if p.ID == *m.PersonaID {
+				return &members[(j+1)%len(members)]
+			}
+		}
+	}
+	return &members[0]
+}
+
+// addressedSpeaker 优先看@名字，其次看直接提到的名字，取最先出现的；同一位置匹配到多个时取名字更长的
+func addressedSpeaker(members []groupMember, input string) *groupMember {
+	for _, prefix := range []string{"@", ""} {
+		var found *groupMember
+		best := -1
+		for i, p := range members {
+			if p.Name == "" {
+				continue
+			}
+			idx := strings.Index(input, prefix+p.Name)
+			if idx < 0 {
+				continue
+			}
+			if best < 0 || idx < best || (idx == best && len(p.Name) > len(found.Name)) {
+				best, found = idx, &members[i]
+			}
+		}
+		if found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// modelChosenSpeaker 让模型根据最近的对话挑选下一位发言的成员，无法识别时返回nil
+func modelChosenSpeaker(session Session, members []groupMember, path []Message, userInput string) *groupMember {
+	var lines []string
+	recent := path
+	if len(recent) > speakerContextMessages {
+		recent = recent[len(recent)-speakerContextMessages:]
+	}
+	for _, m := range recent {
+		if m.Role != "system" {
+			lines = append(lines, speakerLabel(m)+"："+truncateRunes(m.Content, 200))
+		}
+	}
+	lines = append(lines, "用户："+truncateRunes(userInput, 200))
+	prompt := fmt.Sprintf("这是一个群聊，参与的角色有：%s。以下是最近的对话：\n%s\n\n接下来最适合由哪个角色回复？只回答角色名，不要输出其他内容。",
+		strings.Join(memberNames(members), "、"), strings.Join(lines, "\n"))
+	// 与退出意图判断一样是简短的分类调用，共用超时设置
+	out, err := completeText(session, usageSpeaker, prompt, cfg.Timeouts.ExitIntent.Duration)
+	if err != nil {
+		log.Printf("会话%s挑选发言成员失败: %v", session.ID, err)
+		return nil
+	}
+	out = strings.Trim(out, " \t\r\n\"'“”「」@。.")
+	for i, p := range members {
+		if p.Name == out {
+			return &members[i]
+		}
+	}
+	return addressedSpeaker(members, out)
+}
+
+// transcriptRole 总结、摘要等转写中的角色标记，群聊成员的发言用其名字
+func transcriptRole(m Message) string {
+	if m.Role == "assistant" && m.Speaker != "" {
+		return m.Speaker
+	}
+	return m.Role
+}
+
+// speakerLabel 消息在群聊上下文中显示的说话人
+func speakerLabel(m Message) string {
+	switch {
+	case m.Role == "user":
+		return "用户"
+	case m.Speaker != "":
+		return m.Speaker
+	}
+	return "AI"
+}
+
+// groupSystemPrompt 追加在发言成员自己的system prompt之后，说明群聊的规则；
+// 没有指定发言成员时（如查看上下文占用）只列出参与者
+func groupSystemPrompt(speaker Session, names []string) string {
+	prompt := fmt.Sprintf("这是一个多人群聊，参与者有用户和%s。其他人的发言会以“名字：内容”的形式给出。", strings.Join(names, "、"))
+	if speaker.PersonaID != nil {
+		prompt += fmt.Sprintf("你只扮演%s，只以%s的身份说话，不要替其他角色发言，回复开头不要加自己的名字。", speaker.AIName, speaker.AIName)
+	}
+	return prompt
+}
+
+// groupChatMessage 从发言成员的视角转换一条历史消息
+func groupChatMessage(m Message, speakerID *uint) ChatMessage {
+	if m.Role == "assistant" && m.PersonaID != nil && speakerID != nil && *m.PersonaID == *speakerID {
+		return ChatMessage{Role: "assistant", Content: m.Content}
+	}
+	return ChatMessage{Role: "user", Content: speakerLabel(m) + "：" + m.Content}
+}
+
+// mergeSameRole 合并相邻的同角色消息，部分后端（如Anthropic）要求user和assistant交替出现
+func mergeSameRole(msgs []ChatMessage) []ChatMessage {
+	var out []ChatMessage
+	for _, m := range msgs {
+		if n := len(out); n > 0 && m.Role != "system" && out[n-1].Role == m.Role {
+			out[n-1].Content += "\n\n" + m.Content
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// trimSpeakerPrefix 去掉模型模仿上下文格式在回复开头加上的“名字：”
+func trimSpeakerPrefix(content, name string) string {
+	trimmed := strings.TrimLeft(content, " \n")
+	for _, sep := range []string{"：", ":"} {
+		if name != "" && strings.HasPrefix(trimmed, name+sep) {
+			return strings.TrimLeft(strings.TrimPrefix(trimmed, name+sep), " ")
+		}
+	}
+	return content
+}
+
+// GroupMemberInfo 群聊成员及其当前的名称、头像
+type GroupMemberInfo struct {
+	PersonaID uint   `json:"personaId"`
+	Name      string `json:"name"`
+	Avatar    string `json:"avatar"`
+	Position  int    `json:"position"`
+}
+
+// getGroupMembers 查看会话的成员和发言顺序，非群聊返回空列表
+func getGroupMembers(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("sessionId")
+	session, err := findSession(currentUserID(r), sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	members, err := groupMembers(session.ID)
+	if err != nil {
+		http.Error(w, "获取成员失败", http.StatusInternalServerError)
+		return
+	}
+	list := make([]GroupMemberInfo, 0, len(members))
+	for i, p := range members {
+		list = append(list, GroupMemberInfo{PersonaID: p.ID, Name: p.Name, Avatar: p.Avatar, Position: i})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"turnMode": session.TurnMode,
+		"members":  list,
+	})
+}
+
+// updateGroupMembers 设置会话的成员和发言顺序，单人格会话也可以由此变为群聊
+func updateGroupMembers(w http.ResponseWriter, r *http.Request) {
+	var req GroupMembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	userID := currentUserID(r)
+	session, ok := loadActiveSession(w, userID, req.SessionID)
+	if !ok {
+		return
+	}
+	mode, err := normalizeTurnMode(req.TurnMode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	personas, err := loadGroupPersonas(userID, req.PersonaIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, avatar := groupDisplay(personas)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := replaceGroupMembers(tx, session.ID, personas); err != nil {
+			return err
+		}
+		return tx.Model(&Session{}).Where("id = ?", session.ID).Updates(map[string]interface{}{
+			"turn_mode":   mode,
+			"persona_id":  nil,
+			"personality": "",
+			"ai_name":     name,
+			"ai_avatar":   avatar,
+		}).Error
+	})
+	if err != nil {
+		http.Error(w, "设置成员失败", http.StatusInternalServerError)
+		return
+	}
+	events.publish(userID, Event{Type: eventSessionUpdated, SessionID: session.ID})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"result": "success", "turnMode": mode})
+}
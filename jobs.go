@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// 生成标题、结束总结和滚动摘要等不阻塞对话的模型调用放在数据库里的任务队列中，由后台worker执行。
+// 领取任务时加租约，进程重启后租约过期的任务会被重新领取；失败按指数退避重试，
+// 超过次数后进入dead状态（死信），执行该类任务的兜底处理，可通过接口查看和手动重试
+
+const (
+	jobPending = "pending" // 等待执行，包括等待重试
+	jobRunning = "running"
+	jobDone    = "done"
+	jobDead    = "dead" // 重试次数用完
+)
+
+// 任务类型
+const (
+	jobTitle   = "title"   // 首条消息后生成会话标题
+	jobSummary = "summary" // 会话结束后生成总结和新标题
+	jobMemory  = "memory"  // 滚动摘要
+)
+
+// Job 一个后台任务，Payload为JSON，内容由任务类型决定
+type Job struct {
+	ID          uint       `gorm:"primaryKey;size:32" json:"id"`
+	Kind        string     `gorm:"type:varchar(32)" json:"kind"`
+	UserID      *uint      `gorm:"size:32;index" json:"user_id"`
+	User        *User      `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+	SessionID   string     `gorm:"type:varchar(64);index" json:"session_id"`
+	Session     *Session   `gorm:"foreignKey:SessionID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+	Payload     string     `gorm:"type:text" json:"-"`
+	Status      string     `gorm:"type:varchar(16);index:idx_job_status_run" json:"status"`
+	RunAt       time.Time  `gorm:"index:idx_job_status_run" json:"run_at"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	LastError   string     `gorm:"type:text" json:"last_error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// jobHandler 某类任务的执行和死信兜底；run返回错误时重试
+type jobHandler struct {
+	run  func(job Job) error
+	dead func(job Job)
+}
+
+var jobHandlers = map[string]jobHandler{
+	jobTitle:   {run: runTitleJob, dead: titleJobDead},
+	jobSummary: {run: runSummaryJob, dead: summaryJobDead},
+	jobMemory:  {run: runMemoryJob},
+}
+
+// jobWake 有新任务时唤醒空闲的worker，不必等到下一次轮询
+var jobWake = make(chan struct{}, 1)
+
+// enqueueJob 为会话添加一个任务
+func enqueueJob(session Session, kind string, payload interface{}) (Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{
+		Kind:        kind,
+		UserID:      session.UserID,
+		SessionID:   session.ID,
+		Payload:     string(data),
+		Status:      jobPending,
+		RunAt:       time.Now(),
+		MaxAttempts: cfg.Jobs.MaxAttempts,
+	}
+	if err := db.Create(&job).Error; err != nil {
+		return Job{}, err
+	}
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// startJobWorkers 启动worker，并定期清理已完成和已进入死信的旧任务
+func startJobWorkers() {
+	for i := 0; i < cfg.Jobs.Workers; i++ {
+		go jobWorker()
+	}
+	go func() {
+		for {
+			cutoff := time.Now().Add(-cfg.Jobs.Retention.Duration)
+			if err := db.Where("status IN ? AND finished_at < ?", []string{jobDone, jobDead}, cutoff).Delete(&Job{}).Error; err != nil {
+				log.Printf("清理后台任务失败: %v", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func jobWorker() {
+	for {
+		job, err := claimJob()
+		if err != nil {
+			log.Printf("领取后台任务失败: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-jobWake:
+			case <-time.After(cfg.Jobs.PollInterval.Duration):
+			}
+			continue
+		}
+		executeJob(*job)
+	}
+}
+
+// claimJob 取一个到期的任务或租约已过期的执行中任务，按尝试次数做乐观锁，被其他worker抢先时返回nil
+func claimJob() (*Job, error) {
+	now := time.Now()
+	// 没有任务是常态，用Find而不是First，避免每次轮询都记录record not found
+	var jobs []Job
+	err := db.Where("(status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?)", jobPending, now, jobRunning, now).
+		Order("run_at asc, id asc").Limit(1).Find(&jobs).Error
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	job := jobs[0]
+	until := now.Add(cfg.Jobs.Lease.Duration)
+	res := db.Model(&Job{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, job.Status, job.Attempts).
+		Updates(map[string]interface{}{"status": jobRunning, "attempts": job.Attempts + 1, "locked_until": until})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	job.Status, job.Attempts, job.LockedUntil = jobRunning, job.Attempts+1, &until
+	return &job, nil
+}
+
+// executeJob 执行任务并记录结果；重试次数用完时转入死信并执行兜底处理
+func executeJob(job Job) {
+	h, ok := jobHandlers[job.Kind]
+	var err error
+	switch {
+	case !ok:
+		err = fmt.Errorf("未知的任务类型%s", job.Kind)
+		job.Attempts = job.MaxAttempts
+	case job.Attempts > job.MaxAttempts:
+		// 最后一次执行时进程中断，租约过期后不再执行
+		err = errors.New("任务执行中断")
+	default:
+		err = runJobSafely(h.run, job)
+	}
+	now := time.Now()
+	updates := map[string]interface{}{"locked_until": nil}
+	switch {
+	case err == nil:
+		updates["status"], updates["finished_at"], updates["last_error"] = jobDone, now, ""
+	case job.Attempts < job.MaxAttempts:
+		updates["status"], updates["run_at"], updates["last_error"] = jobPending, now.Add(jobRetryDelay(job.Attempts)), err.Error()
+		log.Printf("后台任务%d(%s)第%d次执行失败，稍后重试: %v", job.ID, job.Kind, job.Attempts, err)
+	default:
+		updates["status"], updates["finished_at"], updates["last_error"] = jobDead, now, err.Error()
+		log.Printf("后台任务%d(%s)执行%d次均失败: %v", job.ID, job.Kind, job.Attempts, err)
+	}
+	if e := db.Model(&Job{}).Where("id = ?", job.ID).Updates(updates).Error; e != nil {
+		log.Printf("更新后台任务%d状态失败: %v", job.ID, e)
+	}
+	if updates["status"] == jobDead && ok && h.dead != nil {
+		h.dead(job)
+	}
+}
+
+func runJobSafely(run func(Job) error, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run(job)
+}
+
+// jobRetryDelay 第n次失败后的等待时间，从retry_delay开始翻倍，最多一小时
+func jobRetryDelay(attempt int) time.Duration {
+	d := cfg.Jobs.RetryDelay.Duration << (attempt - 1)
+	if d <= 0 || d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// jobSession 任务所属的会话，会话已删除时返回false
+func jobSession(job Job) (Session, bool, error) {
+	var session Session
+	err := db.Where("id = ?", job.SessionID).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return session, false, nil
+	}
+	return session, err == nil, err
+}
+
+// === 生成标题 ===
+
+type titleJobPayload struct {
+	Message string `json:"message"`
+}
+
+// placeholderTitles 新建会话和生成标题失败时的默认名称，只有这两种名称会被生成的标题覆盖
+var placeholderTitles = []string{"新对话", "主题对话"}
+
+// runTitleJob 用户已手动改名时跳过
+func runTitleJob(job Job) error {
+	var p titleJobPayload
+	if err := json.Unmarshal([]byte(job.Payload), &p); err != nil {
+		return err
+	}
+	session, ok, err := jobSession(job)
+	if !ok || !slices.Contains(placeholderTitles, session.Name) {
+		return err
+	}
+	title, err := generateTitleByAI(session, session.Personality, p.Message)
+	if err != nil {
+		return err
+	}
+	if title == "" {
+		title = "主题对话"
+	}
+	res := db.Model(&Session{}).Where("id = ? AND name IN ?", session.ID, placeholderTitles).Update("name", title)
+	if res.Error == nil && res.RowsAffected > 0 {
+		publishEvent(session.UserID, Event{Type: eventSessionRenamed, SessionID: session.ID, Name: title})
+	}
+	return res.Error
+}
+
+func titleJobDead(job Job) {
+	res := db.Model(&Session{}).Where("id = ? AND name = ?", job.SessionID, "新对话").Update("name", "主题对话")
+	if res.Error == nil && res.RowsAffected > 0 {
+		publishEvent(job.UserID, Event{Type: eventSessionRenamed, SessionID: job.SessionID, Name: "主题对话"})
+	}
+}
+
+// === 结束总结 ===
+
+type summaryJobPayload struct {
+	// EndMessageID 结束提示消息，总结作为它的子消息
+	EndMessageID uint `json:"endMessageId"`
+}
+
+// runSummaryJob 总结结束提示之前的对话；会话已被重新打开时不再写入
+func runSummaryJob(job Job) error {
+	var p summaryJobPayload
+	if err := json.Unmarshal([]byte(job.Payload), &p); err != nil {
+		return err
+	}
+	session, ok, err := jobSession(job)
+	if !ok || !summaryStillWanted(session, p.EndMessageID) {
+		return err
+	}
+	end, err := findMessage(session.ID, p.EndMessageID)
+	if err != nil {
+		return err
+	}
+	msgs, err := pathTo(session.ID, end.ParentID)
+	if err != nil {
+		return err
+	}
+	summary, newTitle, err := summarizeAndTitleByAI(session, sessionPersonality(session), transcriptText(msgs))
+	if err != nil {
+		return err
+	}
+	return saveEndSummary(session, p.EndMessageID, summary, newTitle)
+}
+
+// summaryJobDead 只给会话一个默认标题，不写入总结，手动重试后仍可补上
+func summaryJobDead(job Job) {
+	var p summaryJobPayload
+	if json.Unmarshal([]byte(job.Payload), &p) != nil {
+		return
+	}
+	res := db.Model(&Session{}).Where("id = ? AND terminated = ? AND head_message_id = ?", job.SessionID, true, p.EndMessageID).
+		Update("name", "对话总结")
+	if res.Error == nil && res.RowsAffected > 0 {
+		publishEvent(job.UserID, Event{Type: eventSessionRenamed, SessionID: job.SessionID, Name: "对话总结"})
+	}
+}
+
+func summaryStillWanted(session Session, endID uint) bool {
+	return session.Terminated && session.HeadMessageID != nil && *session.HeadMessageID == endID
+}
+
+// errSummaryStale 会话在总结期间被重新打开
+var errSummaryStale = errors.New("会话已重新打开")
+
+// saveEndSummary 写入总结消息和新标题，只在会话仍停在结束提示上时生效
+func saveEndSummary(session Session, endID uint, summary, newTitle string) error {
+	if newTitle == "" {
+		newTitle = "对话总结"
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		msg := Message{
+			SessionID: session.ID,
+			ParentID:  &endID,
+			Role:      "assistant",
+			Content:   summary,
+			Meta:      summaryMeta,
+		}
+		if err := tx.Create(&msg).Error; err != nil {
+			return err
+		}
+		res := tx.Model(&Session{}).Where("id = ? AND terminated = ? AND head_message_id = ?", session.ID, true, endID).
+			Updates(map[string]interface{}{"head_message_id": msg.ID, "name": newTitle})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errSummaryStale
+		}
+		return nil
+	})
+	if errors.Is(err, errSummaryStale) {
+		return nil
+	}
+	if err == nil {
+		publishEvent(session.UserID, Event{Type: eventSessionRenamed, SessionID: session.ID, Name: newTitle})
+	}
+	return err
+}
+
+// === 滚动摘要 ===
+
+// scheduleMemoryUpdate 回复保存后检查是否需要滚动摘要，未达到阈值或同一会话已有未执行的任务时不添加
+func scheduleMemoryUpdate(session Session) {
+	if !cfg.Memory.Enabled || !memoryDue(session) {
+		return
+	}
+	var n int64
+	db.Model(&Job{}).Where("session_id = ? AND kind = ? AND status = ?", session.ID, jobMemory, jobPending).Count(&n)
+	if n > 0 {
+		return
+	}
+	if _, err := enqueueJob(session, jobMemory, struct{}{}); err != nil {
+		log.Printf("会话%s添加滚动摘要任务失败: %v", session.ID, err)
+	}
+}
+
+// runMemoryJob 同一会话的摘要正在由其他worker生成时直接跳过，那次滚动会一并处理
+func runMemoryJob(job Job) error {
+	session, ok, err := jobSession(job)
+	if !ok {
+		return err
+	}
+	if _, busy := summarizing.LoadOrStore(session.ID, true); busy {
+		return nil
+	}
+	defer summarizing.Delete(session.ID)
+	return rollSummary(session)
+}
+
+// === 状态接口 ===
+
+// getJobs 当前用户的后台任务，可按会话和状态筛选，最新的在前
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	tx := db.Where("user_id = ?", currentUserID(r))
+	if sid := q.Get("sessionId"); sid != "" {
+		tx = tx.Where("session_id = ?", sid)
+	}
+	if status := q.Get("status"); status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	jobs := []Job{}
+	if err := tx.Order("id desc").Limit(limit).Find(&jobs).Error; err != nil {
+		http.Error(w, "查询失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func findUserJob(w http.ResponseWriter, r *http.Request) (Job, bool) {
+	var job Job
+	if err := db.Where("id = ? AND user_id = ?", mux.Vars(r)["id"], currentUserID(r)).First(&job).Error; err != nil {
+		http.Error(w, "任务不存在", http.StatusNotFound)
+		return job, false
+	}
+	return job, true
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := findUserJob(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// retryJob 死信任务重新排队，尝试次数清零
+func retryJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := findUserJob(w, r)
+	if !ok {
+		return
+	}
+	if job.Status != jobDead {
+		http.Error(w, "只能重试失败的任务", http.StatusConflict)
+		return
+	}
+	err := db.Model(&Job{}).Where("id = ? AND status = ?", job.ID, jobDead).Updates(map[string]interface{}{
+		"status":      jobPending,
+		"attempts":    0,
+		"run_at":      time.Now(),
+		"finished_at": nil,
+	}).Error
+	if err != nil {
+		http.Error(w, "重试失败", http.StatusInternalServerError)
+		return
+	}
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"result": "success"})
+}
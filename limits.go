@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 调用模型的接口（对话、重新生成、编辑、结束会话）在进入处理前检查频率限制和用量额度。
+// 额度按usage_records中已记录的用量计算，检查发生在调用之前，因此最后一次请求可能略微超出额度
+
+// rateLimiter 令牌桶，每个键每分钟补充perMinute个令牌，最多积攒perMinute个
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*rateBucket)}
+
+// rateRule 一个令牌桶及其每分钟的令牌数
+type rateRule struct {
+	key       string
+	perMinute int
+	msg       string
+}
+
+// allowAll 所有桶都有令牌时才各取一个，返回各桶剩余的令牌数；
+// 任一桶不足时都不扣，返回该桶的下标和需要等待的时间
+func (l *rateLimiter) allowAll(rules []rateRule) ([]int, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	buckets := make([]*rateBucket, len(rules))
+	for i, rule := range rules {
+		b, ok := l.buckets[rule.key]
+		if !ok {
+			b = &rateBucket{tokens: float64(rule.perMinute), last: now}
+			l.buckets[rule.key] = b
+		}
+		rate := float64(rule.perMinute) / 60
+		b.tokens = math.Min(float64(rule.perMinute), b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+		if b.tokens < 1 {
+			return nil, i, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		}
+		buckets[i] = b
+	}
+	remaining := make([]int, len(rules))
+	for i, b := range buckets {
+		b.tokens--
+		remaining[i] = int(b.tokens)
+	}
+	return remaining, -1, 0
+}
+
+// sweep 每分钟清理一次闲置超过一分钟的桶，它们早已补满，删掉与保留等价
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > time.Minute {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// usageSpend 一段时间内的用量合计
+type usageSpend struct {
+	Tokens int64   `json:"tokens"`
+	Cost   float64 `json:"cost"`
+}
+
+func spendSince(column string, value interface{}, since time.Time) (usageSpend, error) {
+	var s usageSpend
+	err := db.Model(&UsageRecord{}).
+		Select("COALESCE(SUM(total_tokens), 0) AS tokens, COALESCE(SUM(cost), 0) AS cost").
+		Where(column+" = ? AND created_at >= ?", value, since).Scan(&s).Error
+	return s, err
+}
+
+// QuotaStatus 某个范围（用户或会话）在某个周期（当天或当月）内的额度使用情况，限额为0表示不限
+type QuotaStatus struct {
+	Scope       string     `json:"scope"`
+	Period      string     `json:"period"`
+	Used        usageSpend `json:"used"`
+	TokenLimit  int64      `json:"tokenLimit"`
+	CostLimit   float64    `json:"costLimit"`
+	ResetAt     time.Time  `json:"resetAt"`
+	scopeName   string
+	periodLabel string
+}
+
+func (q QuotaStatus) exceeded() bool {
+	return (q.TokenLimit > 0 && q.Used.Tokens >= q.TokenLimit) || (q.CostLimit > 0 && q.Used.Cost >= q.CostLimit)
+}
+
+// quotaStatuses 计算用户和会话在当天、当月的额度使用情况，只包含配置了限额的项
+func quotaStatuses(userID uint, sessionID string) ([]QuotaStatus, error) {
+	now := time.Now()
+	y, m, d := now.Date()
+	dayStart := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	monthStart := time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+
+	type scope struct {
+		name, label, column string
+		value               interface{}
+		rule                LimitRule
+	}
+	scopes := []scope{{"user", "账号", "user_id", userID, cfg.Limits.User}}
+	if sessionID != "" {
+		scopes = append(scopes, scope{"session", "本会话", "session_id", sessionID, cfg.Limits.Session})
+	}
+	var out []QuotaStatus
+	for _, s := range scopes {
+		periods := []struct {
+			name, label string
+			start, end  time.Time
+			tokens      int64
+			cost        float64
+		}{
+			{"day", "今日", dayStart, dayStart.AddDate(0, 0, 1), s.rule.DailyTokens, s.rule.DailyCost},
+			{"month", "本月", monthStart, monthStart.AddDate(0, 1, 0), s.rule.MonthlyTokens, s.rule.MonthlyCost},
+		}
+		for _, p := range periods {
+			if p.tokens <= 0 && p.cost <= 0 {
+				continue
+			}
+			used, err := spendSince(s.column, s.value, p.start)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, QuotaStatus{
+				Scope:       s.name,
+				Period:      p.name,
+				Used:        used,
+				TokenLimit:  p.tokens,
+				CostLimit:   p.cost,
+				ResetAt:     p.end,
+				scopeName:   s.label,
+				periodLabel: p.label,
+			})
+		}
+	}
+	return out, nil
+}
+
+// enforceLimits 检查频率限制和用量额度并写出剩余额度响应头，超出时已写出429响应
+func enforceLimits(w http.ResponseWriter, userID uint, sessionID string) bool {
+	// 先查额度再取令牌，额度用完时不必消耗频率配额
+	quotas, err := quotaStatuses(userID, sessionID)
+	if err != nil {
+		http.Error(w, "额度检查失败", http.StatusInternalServerError)
+		return false
+	}
+	tokensLeft, costLeft := int64(-1), -1.0
+	for _, q := range quotas {
+		if q.TokenLimit > 0 && (tokensLeft < 0 || q.TokenLimit-q.Used.Tokens < tokensLeft) {
+			tokensLeft = max(q.TokenLimit-q.Used.Tokens, 0)
+		}
+		if q.CostLimit > 0 && (costLeft < 0 || q.CostLimit-q.Used.Cost < costLeft) {
+			costLeft = math.Max(q.CostLimit-q.Used.Cost, 0)
+		}
+	}
+	if tokensLeft >= 0 {
+		w.Header().Set("X-Quota-Tokens-Remaining", strconv.FormatInt(tokensLeft, 10))
+	}
+	if costLeft >= 0 {
+		w.Header().Set("X-Quota-Cost-Remaining", strconv.FormatFloat(costLeft, 'f', 6, 64))
+	}
+	for _, q := range quotas {
+		if q.exceeded() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(q.ResetAt).Seconds()))))
+			http.Error(w, fmt.Sprintf("%s%s的用量额度已用完", q.scopeName, q.periodLabel), http.StatusTooManyRequests)
+			return false
+		}
+	}
+
+	var rules []rateRule
+	for _, rule := range []rateRule{
+		{fmt.Sprintf("user:%d", userID), cfg.Limits.User.RequestsPerMinute, "请求过于频繁，请稍后再试"},
+		{"session:" + sessionID, cfg.Limits.Session.RequestsPerMinute, "本会话请求过于频繁，请稍后再试"},
+	} {
+		if rule.perMinute > 0 {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return true
+	}
+	// 用户和会话的令牌一起检查，被会话限制拒绝的请求不占用用户的配额
+	remaining, failed, wait := limiter.allowAll(rules)
+	if failed >= 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rules[failed].perMinute))
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, rules[failed].msg, http.StatusTooManyRequests)
+		return false
+	}
+	// 多个限制同时生效时，响应头报告剩余最少的那个
+	least := 0
+	for i := range rules {
+		if remaining[i] < remaining[least] {
+			least = i
+		}
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rules[least].perMinute))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining[least]))
+	return true
+}
+
+// getQuota 查看当前用户（带sessionId时包括该会话）的额度使用情况
+func getQuota(w http.ResponseWriter, r *http.Request) {
+	userID := currentUserID(r)
+	sessionID := r.URL.Query().Get("sessionId")
+	if sessionID != "" {
+		if _, err := findSession(userID, sessionID); err != nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+	}
+	quotas, err := quotaStatuses(userID, sessionID)
+	if err != nil {
+		http.Error(w, "额度查询失败", http.StatusInternalServerError)
+		return
+	}
+	if quotas == nil {
+		quotas = []QuotaStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"currency": cfg.Pricing.Currency,
+		"rateLimits": map[string]int{
+			"userPerMinute":    cfg.Limits.User.RequestsPerMinute,
+			"sessionPerMinute": cfg.Limits.Session.RequestsPerMinute,
+		},
+		"quotas": quotas,
+	})
+}
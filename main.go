@@ -1,34 +1,26 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
-const (
-	apiKey     = "sk-xxxxxxxxxxxxxxx"
-	model      = "xxxxxxxx-xxxx"
-	apiBaseURL = "https://xxx.com"
-	dsn        = "root:00000000@tcp(127.0.0.1:3306)/deepseek_chat_b?charset=utf8mb4&parseTime=True&loc=Local"
-)//以上内容根据自身实际情况修改数据，谢谢！
-
 var db *gorm.DB
 
 type Persona struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
+	ID          uint      `gorm:"primaryKey;size:32" json:"id"`
 	Name        string    `gorm:"type:varchar(64)" json:"name"`
 	Avatar      string    `gorm:"type:varchar(256)" json:"avatar"`
 	Identity    string    `gorm:"type:varchar(128)" json:"identity"`
@@ -36,29 +28,65 @@ type Persona struct {
 	Personality string    `gorm:"type:text" json:"personality"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	UserID      *uint     `gorm:"size:32;index" json:"user_id"`
+	User        *User     `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+
+	// Params 使用该人格的会话默认的生成参数
+	Params GenerationParams `gorm:"embedded;embeddedPrefix:gen_" json:"params"`
+	// Version 当前内容对应的版本号，历史版本见PersonaRevision
+	Version int `json:"version"`
+	// PromptTemplate 自定义的system prompt模板，为空时使用默认模板，见prompt.go
+	PromptTemplate string `gorm:"type:text" json:"prompt_template"`
 }
 
 type Session struct {
-	ID          string    `gorm:"primaryKey;type:varchar(64)" json:"id"`
-	Name        string    `gorm:"type:varchar(64)" json:"name"`
-	Model       string    `gorm:"type:varchar(64)" json:"model"`
-	Personality string    `gorm:"type:text" json:"personality"`
-	AIName      string    `gorm:"type:varchar(64)" json:"ai_name"`
-	AIAvatar    string    `gorm:"type:varchar(256)" json:"ai_avatar"`
-	Terminated  bool      `gorm:"type:tinyint(1)" json:"terminated"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	PersonaID   *uint     `gorm:"type:int unsigned" json:"persona_id"`
-	Messages    []Message `gorm:"foreignKey:SessionID" json:"messages"`
+	ID          string           `gorm:"primaryKey;type:varchar(64)" json:"id"`
+	Name        string           `gorm:"type:varchar(64)" json:"name"`
+	Model       string           `gorm:"type:varchar(64)" json:"model"`
+	Personality string           `gorm:"type:text" json:"personality"`
+	AIName      string           `gorm:"type:varchar(64)" json:"ai_name"`
+	AIAvatar    string           `gorm:"type:varchar(256)" json:"ai_avatar"`
+	Terminated  bool             `gorm:"type:tinyint(1)" json:"terminated"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	PersonaID   *uint            `gorm:"size:32" json:"persona_id"`
+	UserID      *uint            `gorm:"size:32;index" json:"user_id"`
+	User        *User            `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+	Persona     *Persona         `gorm:"foreignKey:PersonaID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL" json:"-"`
+	Messages    []Message        `gorm:"foreignKey:SessionID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"messages"`
+	Summaries   []SessionSummary `gorm:"foreignKey:SessionID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+
+	// HeadMessageID 当前分支的最后一条消息
+	HeadMessageID *uint `gorm:"size:32" json:"head_message_id"`
+	// PersonaRevisionID 会话固定使用的人格版本，人格修改后需要手动升级
+	PersonaRevisionID *uint `gorm:"size:32" json:"persona_revision_id"`
+	// Params 本会话覆盖的生成参数，未设置的字段沿用人格的默认值
+	Params GenerationParams `gorm:"embedded;embeddedPrefix:gen_" json:"params"`
+	// PendingExitID 识别到退出意图、等待用户确认的那条用户消息
+	PendingExitID *uint `gorm:"size:32" json:"pending_exit_id"`
+	// ExitMessageID 因退出意图结束时触发结束的那条用户消息，它没有回复，重新打开时一并撤回
+	ExitMessageID *uint `gorm:"size:32" json:"-"`
+	// NameBeforeEnd 结束前的会话名称，总结任务会改名，重新打开时恢复；结束后手动改名则清空
+	NameBeforeEnd string `gorm:"type:varchar(64)" json:"-"`
+	// TurnMode 群聊的发言顺序，为空表示单人格会话；群聊成员见SessionMember
+	TurnMode string          `gorm:"type:varchar(16)" json:"turn_mode"`
+	Members  []SessionMember `gorm:"foreignKey:SessionID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
 }
 
 type Message struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
+	ID        uint      `gorm:"primaryKey;size:32" json:"id"`
 	SessionID string    `gorm:"type:varchar(64);index" json:"session_id"`
+	ParentID  *uint     `gorm:"size:32;index" json:"parent_id"`
 	Role      string    `gorm:"type:varchar(16)" json:"role"`
 	Content   string    `gorm:"type:text" json:"content"`
 	Meta      string    `gorm:"type:varchar(128)" json:"meta"`
 	CreatedAt time.Time `json:"created_at"`
+	// Siblings 同一父消息下的全部候选（含自身），只有一个时省略
+	Siblings []uint `gorm:"-" json:"siblings,omitempty"`
+	// 群聊中回复的人格及其当时的名称、头像，人格删除后仍按原样显示
+	PersonaID     *uint  `gorm:"size:32" json:"persona_id,omitempty"`
+	Speaker       string `gorm:"type:varchar(64)" json:"speaker,omitempty"`
+	SpeakerAvatar string `gorm:"type:varchar(256)" json:"speaker_avatar,omitempty"`
 }
 
 type ModelSetupRequest struct {
@@ -67,11 +95,18 @@ type ModelSetupRequest struct {
 	AIName      string `json:"aiName"`
 	AIAvatar    string `json:"aiAvatar"`
 	PersonaID   *uint  `json:"personaId"`
+	// Params 本会话的生成参数，覆盖人格上的默认值
+	Params GenerationParams `json:"params"`
+	// PersonaIDs 不少于两个时创建群聊，此时忽略PersonaID
+	PersonaIDs []uint `json:"personaIds"`
+	TurnMode   string `json:"turnMode"`
 }
 
 type ChatRequest struct {
 	SessionID string `json:"sessionId"`
 	Message   string `json:"message"`
+	// SpeakerID 群聊中指定由哪个成员回复，为空时按发言顺序
+	SpeakerID *uint `json:"speakerId"`
 }
 
 type RenameSessionRequest struct {
@@ -88,58 +123,121 @@ type TerminateSessionRequest struct {
 }
 
 type UploadAvatarResponse struct {
-	Url string `json:"url"`
+	Url      string `json:"url"`
+	ThumbUrl string `json:"thumbUrl"`
 }
 
 func main() {
 	var err error
-	db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	var action cliAction
+	cfg, action, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal("配置加载失败: ", err)
+	}
+	if action.PrintConfig {
+		fmt.Print(cfg.Redacted())
+		return
+	}
+	if err := initExitClassifier(cfg); err != nil {
+		log.Fatal("退出意图分类器初始化失败: ", err)
+	}
+	if action.EvalExitIntent != "" {
+		if err := evalExitIntent(action.EvalExitIntent, os.Stdout); err != nil {
+			log.Fatal("评估失败: ", err)
+		}
+		return
+	}
+	log.Printf("生效配置:\n%s", cfg.Redacted())
+
+	db, err = openDatabase(cfg.Database)
 	if err != nil {
 		log.Fatal("数据库连接失败: ", err)
 	}
-	if err := db.AutoMigrate(&Session{}, &Message{}, &Persona{}); err != nil {
+	if err := migrate(db); err != nil {
 		log.Fatal("数据库自动迁移失败: ", err)
 	}
+	if err := initModels(cfg); err != nil {
+		log.Fatal("模型后端初始化失败: ", err)
+	}
+	startJobWorkers()
 
 	r := mux.NewRouter()
+	r.PathPrefix(cfg.Upload.URLPrefix).Handler(http.StripPrefix(cfg.Upload.URLPrefix, http.FileServer(http.Dir(cfg.Upload.Dir))))
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
 	r.HandleFunc("/", serveIndex)
-	r.HandleFunc("/api/setup", handleSetup).Methods("POST")
-	r.HandleFunc("/api/chat", handleChat).Methods("POST")
-	r.HandleFunc("/api/sessions", getSessions).Methods("GET")
-	r.HandleFunc("/api/messages", getMessages).Methods("GET")
-	r.HandleFunc("/api/session/delete", deleteSession).Methods("POST")
-	r.HandleFunc("/api/session/rename", renameSession).Methods("POST")
-	r.HandleFunc("/api/upload_avatar", uploadAvatar).Methods("POST")
-	r.HandleFunc("/api/session/terminate", terminateSession).Methods("POST")
+	r.HandleFunc("/login", serveLogin)
+	// 登录相关，无需登录即可访问
+	r.HandleFunc("/api/auth/register", handleRegister).Methods("POST")
+	r.HandleFunc("/api/auth/login", handleLogin).Methods("POST")
+	r.HandleFunc("/api/auth/logout", handleLogout).Methods("POST")
+
+	// 其余接口都需要登录，且只能访问自己的会话和人格
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(requireAuth)
+	api.HandleFunc("/auth/me", handleMe).Methods("GET")
+	api.HandleFunc("/setup", handleSetup).Methods("POST")
+	api.HandleFunc("/chat", handleChat).Methods("POST")
+	api.HandleFunc("/chat/stream", handleChatStream).Methods("POST")
+	api.HandleFunc("/sessions", getSessions).Methods("GET")
+	api.HandleFunc("/messages", getMessages).Methods("GET")
+	api.HandleFunc("/session/context", getSessionContext).Methods("GET")
+	api.HandleFunc("/session/summaries", getSessionSummaries).Methods("GET")
+	api.HandleFunc("/session/delete", deleteSession).Methods("POST")
+	api.HandleFunc("/session/rename", renameSession).Methods("POST")
+	api.HandleFunc("/upload_avatar", uploadAvatar).Methods("POST")
+	api.HandleFunc("/models", handleListModels).Methods("GET")
+	api.HandleFunc("/session/model", switchSessionModel).Methods("POST")
+	api.HandleFunc("/session/terminate", terminateSession).Methods("POST")
+	api.HandleFunc("/session/confirm_exit", confirmExit).Methods("POST")
+	api.HandleFunc("/session/reopen", reopenSession).Methods("POST")
+	// 重新生成、编辑与分支切换
+	api.HandleFunc("/message/regenerate", regenerateReply).Methods("POST")
+	api.HandleFunc("/message/edit", editMessage).Methods("POST")
+	api.HandleFunc("/session/switch_branch", switchBranch).Methods("POST")
+	api.HandleFunc("/export", exportSessions).Methods("GET")
+	api.HandleFunc("/search", handleSearch).Methods("GET")
+	api.HandleFunc("/usage", handleUsage).Methods("GET")
+	api.HandleFunc("/quota", getQuota).Methods("GET")
+	api.HandleFunc("/jobs", getJobs).Methods("GET")
+	api.HandleFunc("/jobs/{id}", getJob).Methods("GET")
+	api.HandleFunc("/jobs/{id}/retry", retryJob).Methods("POST")
+	api.HandleFunc("/events", handleEvents).Methods("GET")
 	// 人格相关
-	r.HandleFunc("/api/personas", getPersonas).Methods("GET")
-	r.HandleFunc("/api/persona", createOrUpdatePersona).Methods("POST")
-	r.HandleFunc("/api/persona/{id}", getPersonaByID).Methods("GET")
-	r.HandleFunc("/api/persona/{id}", deletePersona).Methods("DELETE")
-	r.HandleFunc("/api/session/use_persona", usePersonaForSession).Methods("POST")
+	api.HandleFunc("/personas", getPersonas).Methods("GET")
+	api.HandleFunc("/persona", createOrUpdatePersona).Methods("POST")
+	api.HandleFunc("/persona/{id}", getPersonaByID).Methods("GET")
+	api.HandleFunc("/persona/{id}", deletePersona).Methods("DELETE")
+	api.HandleFunc("/persona/import", importPersonaCard).Methods("POST")
+	api.HandleFunc("/persona/{id}/export", exportPersonaCard).Methods("GET")
+	api.HandleFunc("/session/use_persona", usePersonaForSession).Methods("POST")
+	api.HandleFunc("/session/members", getGroupMembers).Methods("GET")
+	api.HandleFunc("/session/members", updateGroupMembers).Methods("POST")
+	api.HandleFunc("/persona/preview_prompt", previewPrompt).Methods("POST")
+	api.HandleFunc("/persona/{id}/revisions", getPersonaRevisions).Methods("GET")
+	api.HandleFunc("/persona/{id}/diff", getPersonaDiff).Methods("GET")
+	api.HandleFunc("/persona/{id}/rollback", rollbackPersona).Methods("POST")
+	api.HandleFunc("/session/persona_revision", getSessionPersonaRevision).Methods("GET")
+	api.HandleFunc("/session/upgrade_persona", upgradeSessionPersona).Methods("POST")
 
-	fmt.Println("服务器启动在 http://localhost:8888")
-	log.Fatal(http.ListenAndServe(":8888", r))
+	srv := &http.Server{
+		Addr:        cfg.Server.Listen,
+		Handler:     r,
+		ReadTimeout: cfg.Server.ReadTimeout.Duration,
+	}
+	fmt.Println("服务器启动在 " + cfg.Server.Listen)
+	log.Fatal(srv.ListenAndServe())
 }
 
 func serveIndex(w http.ResponseWriter, r *http.Request) {
+	if userFromCookie(r) == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
 	http.ServeFile(w, r, "static/index.html")
 }
 
-func buildSystemMessageFromPersona(p Persona) string {
-	systemMsg := fmt.Sprintf("你是一个名为%s的AI助手。", p.Name)
-	if p.Identity != "" {
-		systemMsg += fmt.Sprintf(" 你的身份是：%s。", p.Identity)
-	}
-	if p.Appearance != "" {
-		systemMsg += fmt.Sprintf(" 你的外貌特征：%s。", p.Appearance)
-	}
-	if p.Personality != "" {
-		systemMsg += fmt.Sprintf(" 你的人格特点：%s。", p.Personality)
-	}
-	systemMsg += " 请简洁、准确地回答用户的问题。"
-	return systemMsg
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "static/login.html")
 }
 
 func handleSetup(w http.ResponseWriter, r *http.Request) {
@@ -148,23 +246,58 @@ func handleSetup(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	if err := req.Params.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	userID := currentUserID(r)
+	var members []Persona
+	if len(req.PersonaIDs) > 0 {
+		mode, err := normalizeTurnMode(req.TurnMode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if members, err = loadGroupPersonas(userID, req.PersonaIDs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.TurnMode = mode
+		req.PersonaID = nil
+	}
 	var persona *Persona
 	if req.PersonaID != nil {
 		var p Persona
-		if err := db.First(&p, *req.PersonaID).Error; err == nil {
+		if err := db.Where("user_id = ?", userID).First(&p, *req.PersonaID).Error; err == nil {
 			persona = &p
 		}
 	}
 
+	// 未指定模型时使用默认模型
+	model := models[0]
+	if req.ModelName != "" {
+		m, ok := findModel(req.ModelName)
+		if !ok {
+			http.Error(w, "模型不存在", http.StatusBadRequest)
+			return
+		}
+		model = m
+	}
+
 	sessionID := generateSessionID()
 	session := Session{
 		ID:         sessionID,
 		Name:       "新对话",
-		Model:      req.ModelName,
+		Model:      model.Name,
 		Terminated: false,
+		UserID:     &userID,
+		Params:     req.Params,
 	}
-	if persona != nil {
+	if members != nil {
+		session.TurnMode = req.TurnMode
+		session.AIName, session.AIAvatar = groupDisplay(members)
+	} else if persona != nil {
 		session.Personality = persona.Personality
 		session.AIName = persona.Name
 		session.AIAvatar = persona.Avatar
@@ -180,25 +313,58 @@ func handleSetup(w http.ResponseWriter, r *http.Request) {
 	if session.AIAvatar == "" {
 		session.AIAvatar = "/static/ai_avatar.png"
 	}
-	if err := db.Create(&session).Error; err != nil {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if persona != nil {
+			revID, err := latestRevisionID(tx, persona.ID)
+			if err != nil {
+				return err
+			}
+			session.PersonaRevisionID = revID
+		}
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		if members != nil {
+			return replaceGroupMembers(tx, sessionID, members)
+		}
+		return nil
+	})
+	if err != nil {
 		http.Error(w, "会话创建失败", http.StatusInternalServerError)
 		return
 	}
 	var sysMsg Message
-	if persona != nil {
+	if members != nil {
+		names := make([]string, len(members))
+		for i, p := range members {
+			names[i] = p.Name
+		}
+		sysMsg = Message{
+			SessionID: sessionID,
+			Role:      "system",
+			Content:   groupSystemPrompt(session, names),
+		}
+	} else if persona != nil {
 		sysMsg = Message{
 			SessionID: sessionID,
 			Role:      "system",
-			Content:   buildSystemMessageFromPersona(*persona),
+			Content:   buildSystemMessageFromPersona(*persona, session),
 		}
 	} else {
 		sysMsg = Message{
 			SessionID: sessionID,
 			Role:      "system",
-			Content:   buildSystemMessage(req.ModelName, req.Personality),
+			Content:   buildSystemMessage(session),
 		}
 	}
-	db.Create(&sysMsg)
+	if err := appendMessage(&sysMsg); err != nil {
+		// 没有system prompt的会话不能使用，连同成员一起删除
+		db.Where("session_id = ?", sessionID).Delete(&SessionMember{})
+		db.Where("id = ?", sessionID).Delete(&Session{})
+		http.Error(w, "会话创建失败", http.StatusInternalServerError)
+		return
+	}
+	events.publish(userID, Event{Type: eventSessionCreated, SessionID: sessionID, Name: session.Name})
 	response := map[string]string{
 		"sessionId": sessionID,
 		"message":   "模型设置成功",
@@ -207,228 +373,333 @@ func handleSetup(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// 新增：用AI识别退出意图
-func checkExitIntent(userInput string, personality string) bool {
+// checkExitIntent 识别退出意图：先用本地分类器，无法确定时再问模型
+func checkExitIntent(session Session, userInput string, personality string) bool {
+	switch v, _ := exitIntent.classify(userInput); v {
+	case exitYes:
+		return true
+	case exitNo:
+		return false
+	}
 	prompt := fmt.Sprintf(`你是一个AI助手，你的人格特点为：%s。
 用户刚才说的话是：“%s”。
 请判断用户是否有“结束/退出/终止/再见/不再聊”等终止本次对话的意图。
 如果有请只回答"YES"，否则请只回答"NO"。不要输出其他内容。`, personality, userInput)
-	reqBody := map[string]interface{}{
-		"model": model,
-		"messages": []map[string]string{
-			{"role": "user", "content": prompt},
-		},
-	}
-	jsonBody, _ := json.Marshal(reqBody)
-	req, err := http.NewRequest("POST", apiBaseURL, bytes.NewBuffer(jsonBody))
+	out, err := completeText(session, usageExitIntent, prompt, cfg.Timeouts.ExitIntent.Duration)
 	if err != nil {
 		return false
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
+	return strings.ToUpper(out) == "YES"
+}
+
+func handleChat(w http.ResponseWriter, r *http.Request) {
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	session, ok := loadActiveSession(w, currentUserID(r), req.SessionID)
+	if !ok {
+		return
+	}
+	if !checkSpeaker(w, session, req.SpeakerID) {
+		return
+	}
+	if !enforceLimits(w, currentUserID(r), session.ID) {
+		return
+	}
+
+	// 1. 判断是否有退出意图，有则等待用户确认
+	if checkExitIntent(session, req.Message, sessionPersonality(session)) {
+		resp, err := markPendingExit(session, req.Message)
+		if err != nil {
+			http.Error(w, "保存消息失败", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	// --- 正常对话流程 ---
+	speaker, err := speakerSession(session, session.HeadMessageID, req.Message, req.SpeakerID)
 	if err != nil {
-		return false
+		http.Error(w, "选择回复成员失败", http.StatusInternalServerError)
+		return
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return false
+	chatMsgs, ctxStats, err := buildChatMessages(speaker, session.HeadMessageID, req.Message)
+	if err != nil {
+		http.Error(w, "获取历史消息失败", http.StatusInternalServerError)
+		return
 	}
-	var apiResp struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
+	userMsg, err := saveUserMessage(session, req.Message)
+	if err != nil {
+		http.Error(w, "保存消息失败", http.StatusInternalServerError)
+		return
 	}
-	if err := json.Unmarshal(body, &apiResp); err != nil {
-		return false
+
+	startTime := time.Now()
+	response, err := callChatModel(speaker, chatMsgs)
+	elapsedTime := time.Since(startTime)
+	if err != nil {
+		log.Printf("模型调用失败 session=%s: %v", session.ID, err)
+		discardUserMessage(session, userMsg)
+		ue := newUpstreamError(err)
+		http.Error(w, ue.Message, ue.Status)
+		return
 	}
-	if len(apiResp.Choices) > 0 {
-		ans := strings.TrimSpace(strings.ToUpper(apiResp.Choices[0].Message.Content))
-		return ans == "YES"
+	aiMsg, err := saveAssistantReply(speaker, userMsg.ID, response, elapsedTime)
+	if err != nil {
+		log.Printf("会话%s保存回复失败: %v", session.ID, err)
+		discardUserMessage(session, userMsg)
+		http.Error(w, "保存回复失败", http.StatusInternalServerError)
+		return
 	}
-	return false
+	scheduleMemoryUpdate(session)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chatReplyResponse(speaker, aiMsg, response, elapsedTime, ctxStats))
 }
 
-func handleChat(w http.ResponseWriter, r *http.Request) {
-	var req ChatRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+// chatReplyResponse 对话类接口返回的回复内容
+func chatReplyResponse(session Session, aiMsg Message, res *CompletionResult, elapsed time.Duration, stats ContextStats) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          aiMsg.ID,
+		"message":     aiMsg.Content,
+		"meta":        aiMsg.Meta,
+		"elapsedTime": formatDuration(elapsed),
+		"usage":       res.Usage,
+		"cost":        priceFor(modelFor(session).Model).cost(res.Usage),
+		"model":       modelFor(session).Name,
+		"context":     stats,
+		"aiName":      session.AIName,
+		"aiAvatar":    session.AIAvatar,
+		"personaId":   aiMsg.PersonaID,
 	}
+}
+
+// findSession 只查当前用户自己的会话，别人的会话与不存在同样处理
+func findSession(userID uint, sessionID string) (Session, error) {
 	var session Session
-	if err := db.Where("id = ?", req.SessionID).First(&session).Error; err != nil {
+	err := db.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error
+	return session, err
+}
+
+// loadActiveSession 读取可继续对话的会话，失败时已写出错误响应
+func loadActiveSession(w http.ResponseWriter, userID uint, sessionID string) (Session, bool) {
+	session, err := findSession(userID, sessionID)
+	if err != nil {
 		http.Error(w, "Session not found", http.StatusNotFound)
-		return
+		return session, false
 	}
 	if session.Terminated {
 		http.Error(w, "对话已终止", http.StatusForbidden)
-		return
+		return session, false
 	}
+	return session, true
+}
 
-	// 1. 判断是否有退出意图
+// sessionPersonality 会话关联了人格时以所固定版本的设定为准
+func sessionPersonality(session Session) string {
 	var personality string
-	if session.PersonaID != nil && *session.PersonaID > 0 {
-		var persona Persona
-		if err := db.First(&persona, *session.PersonaID).Error; err == nil {
-			personality = persona.Personality
-		}
+	if persona, ok := sessionPersona(session); ok {
+		personality = persona.Personality
 	}
 	if personality == "" {
 		personality = session.Personality
 	}
+	return personality
+}
 
-	if checkExitIntent(req.Message, personality) {
-		// 自动终止流程
-		var msgs []Message
-		if err := db.Where("session_id = ?", req.SessionID).Order("created_at asc").Find(&msgs).Error; err != nil {
-			http.Error(w, "获取消息失败", http.StatusInternalServerError)
-			return
-		}
-		var allContents []string
-		for _, m := range msgs {
-			allContents = append(allContents, fmt.Sprintf("[%s]: %s", m.Role, m.Content))
-		}
-		allText := strings.Join(allContents, "\n")
-
-		var summary, newTitle string
-		summary, newTitle = summarizeAndTitleByAI(personality, allText)
-		if newTitle == "" {
-			newTitle = "对话总结"
-		}
-		db.Model(&Session{}).Where("id = ?", req.SessionID).Updates(map[string]interface{}{
-			"terminated": true,
-			"name":       newTitle,
-		})
-		endMsg := Message{
-			SessionID: req.SessionID,
-			Role:      "system",
-			Content:   "本次会话已结束，感谢您的使用",
-		}
-		db.Create(&endMsg)
-		summaryMsg := Message{
-			SessionID: req.SessionID,
-			Role:      "assistant",
-			Content:   summary,
-			Meta:      "对话总结",
-		}
-		db.Create(&summaryMsg)
-		// 返回与terminate一致
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"terminated": true,
-			"endMessage": "本次会话已结束，感谢您的使用",
-			"summary":    summary,
-			"newTitle":   newTitle,
-		})
-		return
+// buildChatMessages 构造发给模型的消息：最新的system prompt、leafID所在分支上预算内的历史消息和本轮用户输入
+func buildChatMessages(session Session, leafID *uint, userInput string) ([]ChatMessage, ContextStats, error) {
+	history, err := loadChatHistory(session, leafID)
+	if err != nil {
+		return nil, ContextStats{}, err
+	}
+	input := ChatMessage{Role: "user", Content: userInput}
+	if isGroup(session) {
+		input.Content = "用户：" + userInput
+	}
+	all := append(history, input)
+	if isGroup(session) {
+		all = mergeSameRole(all)
+	}
+	budget := budgetForSession(session)
+	chatMsgs, dropped := fitContext(all, budget.Budget, cfg.Context.KeepRecent)
+	stats := contextStats(budget, all, chatMsgs, len(dropped))
+	if stats.DroppedMessages > 0 {
+		log.Printf("会话%s超出上下文预算(%d)，省略了%d条早期消息", session.ID, budget.Budget, stats.DroppedMessages)
 	}
+	return chatMsgs, stats, nil
+}
 
-	// --- 正常对话流程 ---
-	var msgs []Message
-	if err := db.Where("session_id = ?", req.SessionID).Order("created_at asc").Find(&msgs).Error; err != nil {
-		http.Error(w, "获取历史消息失败", http.StatusInternalServerError)
-		return
+// loadChatHistory 用按所固定人格版本生成的system prompt替换历史中的system消息，已被滚动摘要覆盖的消息以摘要代替，
+// 返回以system开头的、leafID所在分支上的全部历史
+func loadChatHistory(session Session, leafID *uint) ([]ChatMessage, error) {
+	msgs, err := pathTo(session.ID, leafID)
+	if err != nil {
+		return nil, err
 	}
 
 	// === 构造system prompt ===
 	var systemPrompt string
-	if session.PersonaID != nil && *session.PersonaID > 0 {
-		var persona Persona
-		if err := db.First(&persona, *session.PersonaID).Error; err == nil {
-			systemPrompt = buildSystemMessageFromPersona(persona)
-		}
+	if persona, ok := sessionPersona(session); ok {
+		systemPrompt = buildSystemMessageFromPersona(persona, session)
 	}
 	if systemPrompt == "" {
-		systemPrompt = buildSystemMessage(session.Model, session.Personality)
+		systemPrompt = buildSystemMessage(session)
+	}
+	if isGroup(session) {
+		members, err := groupMembers(session.ID)
+		if err != nil {
+			return nil, err
+		}
+		systemPrompt += "\n" + groupSystemPrompt(session, memberNames(members))
 	}
 
 	// 替换system消息
-	chatMsgs := []struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	}{}
-	systemAdded := false
-	for _, m := range msgs {
-		if m.Role == "system" && !systemAdded {
-			chatMsgs = append(chatMsgs, struct {
-				Role    string "json:\"role\""
-				Content string "json:\"content\""
-			}{Role: "system", Content: systemPrompt})
-			systemAdded = true
-		} else if m.Role != "system" {
-			chatMsgs = append(chatMsgs, struct {
-				Role    string "json:\"role\""
-				Content string "json:\"content\""
-			}{Role: m.Role, Content: m.Content})
+	chatMsgs := []ChatMessage{{Role: "system", Content: systemPrompt}}
+	summary, rest := summaryOnPath(session.ID, msgs)
+	if summary != nil {
+		chatMsgs = append(chatMsgs, ChatMessage{Role: "system", Content: summaryPrompt(summary.Content)})
+	}
+	for _, m := range rest {
+		switch {
+		case m.Role == "system":
+		case isGroup(session):
+			chatMsgs = append(chatMsgs, groupChatMessage(m, session.PersonaID))
+		default:
+			chatMsgs = append(chatMsgs, ChatMessage{Role: m.Role, Content: m.Content})
 		}
 	}
-	if !systemAdded {
-		chatMsgs = append([]struct {
-			Role    string "json:\"role\""
-			Content string "json:\"content\""
-		}{{Role: "system", Content: systemPrompt}}, chatMsgs...)
-	}
-	chatMsgs = append(chatMsgs, struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	}{Role: "user", Content: req.Message})
+	return chatMsgs, nil
+}
 
+// saveUserMessage 在当前分支末尾保存用户消息，会话的第一条用户消息会触发异步生成标题
+func saveUserMessage(session Session, content string) (Message, error) {
 	var userMsgCount int64
-	db.Model(&Message{}).Where("session_id = ? AND role = ?", req.SessionID, "user").Count(&userMsgCount)
+	db.Model(&Message{}).Where("session_id = ? AND role = ?", session.ID, "user").Count(&userMsgCount)
 
 	userMsg := Message{
-		SessionID: req.SessionID,
+		SessionID: session.ID,
+		ParentID:  session.HeadMessageID,
 		Role:      "user",
-		Content:   req.Message,
+		Content:   content,
+	}
+	if err := appendMessage(&userMsg); err != nil {
+		return userMsg, err
 	}
-	db.Create(&userMsg)
 
 	if userMsgCount == 0 {
-		go func(sessID, personality, message string) {
-			title := generateTitleByAI(personality, message)
-			if title == "" {
-				title = "主题对话"
-			}
-			db.Model(&Session{}).Where("id = ?", sessID).Update("name", title)
-		}(req.SessionID, session.Personality, req.Message)
+		if _, err := enqueueJob(session, jobTitle, titleJobPayload{Message: content}); err != nil {
+			log.Printf("会话%s添加生成标题任务失败: %v", session.ID, err)
+		}
 	}
+	return userMsg, nil
+}
 
-	startTime := time.Now()
-	response, err := callDeepseekAPI(chatMsgs)
-	elapsedTime := time.Since(startTime)
+// discardUserMessage 模型调用失败时撤销本轮保存的用户消息，当前分支回到请求前的位置，
+// 避免留下没有回复的孤立消息
+func discardUserMessage(session Session, userMsg Message) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&Message{}, userMsg.ID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Session{}).Where("id = ? AND head_message_id = ?", session.ID, userMsg.ID).
+			Update("head_message_id", session.HeadMessageID).Error
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("API调用失败: %v", err), http.StatusInternalServerError)
-		return
+		log.Printf("会话%s撤销用户消息%d失败: %v", session.ID, userMsg.ID, err)
 	}
-	reply := response.Choices[0].Message.Content
+}
+
+// saveAssistantReply 保存模型回复作为parentID的子消息，响应时间和token用量记录在Meta中，并计入用量统计；
+// 保存失败时用量照常记录，但不关联消息
+func saveAssistantReply(session Session, parentID uint, res *CompletionResult, elapsed time.Duration) (Message, error) {
 	aiMsg := Message{
-		SessionID: req.SessionID,
+		SessionID: session.ID,
+		ParentID:  &parentID,
 		Role:      "assistant",
-		Content:   reply,
-		Meta:      fmt.Sprintf("响应时间: %s", formatDuration(elapsedTime)),
+		Content:   res.Content,
+		Meta:      formatReplyMeta(elapsed, res.Usage),
+	}
+	// 群聊中session为发言成员的身份
+	if isGroup(session) {
+		aiMsg.Content = trimSpeakerPrefix(res.Content, session.AIName)
+		aiMsg.PersonaID = session.PersonaID
+		aiMsg.Speaker = session.AIName
+		aiMsg.SpeakerAvatar = session.AIAvatar
+	}
+	if err := appendMessage(&aiMsg); err != nil {
+		recordUsage(session, usageChat, modelFor(session).Model, nil, res.Usage, elapsed)
+		return aiMsg, err
+	}
+	recordUsage(session, usageChat, modelFor(session).Model, &aiMsg.ID, res.Usage, elapsed)
+	return aiMsg, nil
+}
+
+func formatReplyMeta(elapsed time.Duration, usage Usage) string {
+	meta := fmt.Sprintf("响应时间: %s", formatDuration(elapsed))
+	if usage.TotalTokens > 0 {
+		meta += fmt.Sprintf(" | Tokens: %d (输入%d/输出%d)", usage.TotalTokens, usage.PromptTokens, usage.CompletionTokens)
 	}
-	db.Create(&aiMsg)
+	return meta
+}
 
-	chatResponse := map[string]interface{}{
-		"message":     reply,
-		"elapsedTime": formatDuration(elapsedTime),
-		"usage":       response.Usage,
-		"aiName":      session.AIName,
-		"aiAvatar":    session.AIAvatar,
+// 会话结束时写入的两条消息：结束提示和对话总结
+const (
+	sessionEndedText = "本次会话已结束，感谢您的使用"
+	summaryMeta      = "对话总结"
+)
+
+// finishSession 终止会话并写入结束消息，总结和新标题由后台任务生成；手动终止和自动终止共用
+func finishSession(session Session) (Job, error) {
+	err := db.Model(&Session{}).Where("id = ?", session.ID).Updates(map[string]interface{}{
+		"terminated":      true,
+		"pending_exit_id": nil,
+		"exit_message_id": session.PendingExitID,
+		"name_before_end": session.Name,
+	}).Error
+	if err != nil {
+		return Job{}, err
+	}
+	endMsg := Message{
+		SessionID: session.ID,
+		ParentID:  session.HeadMessageID,
+		Role:      "system",
+		Content:   sessionEndedText,
+	}
+	if err := appendMessage(&endMsg); err != nil {
+		return Job{}, err
+	}
+	publishEvent(session.UserID, Event{Type: eventSessionTerminated, SessionID: session.ID})
+	return enqueueJob(session, jobSummary, summaryJobPayload{EndMessageID: endMsg.ID})
+}
+
+// transcriptText 总结用的对话文本
+func transcriptText(msgs []Message) string {
+	var lines []string
+	for _, m := range msgs {
+		lines = append(lines, fmt.Sprintf("[%s]: %s", transcriptRole(m), m.Content))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// terminatedResponse summaryJobId为生成总结的后台任务，完成后总结出现在消息列表中
+func terminatedResponse(job Job) map[string]interface{} {
+	return map[string]interface{}{
+		"terminated":   true,
+		"endMessage":   sessionEndedText,
+		"summaryJobId": job.ID,
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(chatResponse)
 }
 
 // 人格详情
 func getPersonaByID(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	var p Persona
-	if err := db.First(&p, id).Error; err != nil {
+	if err := db.Where("user_id = ?", currentUserID(r)).First(&p, id).Error; err != nil {
 		http.Error(w, "未找到该人格", http.StatusNotFound)
 		return
 	}
@@ -442,8 +713,8 @@ func terminateSession(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "参数错误", http.StatusBadRequest)
 		return
 	}
-	var session Session
-	if err := db.Where("id = ?", req.SessionID).First(&session).Error; err != nil {
+	session, err := findSession(currentUserID(r), req.SessionID)
+	if err != nil {
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
 	}
@@ -451,129 +722,135 @@ func terminateSession(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "对话已终止", http.StatusBadRequest)
 		return
 	}
-	var msgs []Message
-	if err := db.Where("session_id = ?", req.SessionID).Order("created_at asc").Find(&msgs).Error; err != nil {
-		http.Error(w, "获取消息失败", http.StatusInternalServerError)
+	if !enforceLimits(w, currentUserID(r), session.ID) {
 		return
 	}
-	var allContents []string
-	for _, m := range msgs {
-		allContents = append(allContents, fmt.Sprintf("[%s]: %s", m.Role, m.Content))
+	job, err := finishSession(session)
+	if err != nil {
+		http.Error(w, "终止失败", http.StatusInternalServerError)
+		return
 	}
-	allText := strings.Join(allContents, "\n")
 
-	summary, newTitle := summarizeAndTitleByAI(session.Personality, allText)
-	if newTitle == "" {
-		newTitle = "对话总结"
-	}
-	db.Model(&Session{}).Where("id = ?", req.SessionID).Updates(map[string]interface{}{
-		"terminated": true,
-		"name":       newTitle,
-	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": "success", "summaryJobId": job.ID})
+}
 
-	endMsg := Message{
-		SessionID: req.SessionID,
-		Role:      "system",
-		Content:   "本次会话已结束，感谢您的使用",
+func summarizeAndTitleByAI(session Session, personality, allText string) (string, string, error) {
+	prompt := fmt.Sprintf("你是一个AI助手，人格特点：%s。请总结以下对话内容，并用一句话（不超过20字）生成一个合适的标题。\n\n对话内容：\n%s\n\n请先输出对话总结，再输出标题（格式：总结\\n标题：xxxx）。", personality, allText)
+	out, err := completeText(session, usageSummary, prompt, cfg.Timeouts.Summary.Duration)
+	if err != nil {
+		return "", "", err
 	}
-	db.Create(&endMsg)
-	summaryMsg := Message{
-		SessionID: req.SessionID,
-		Role:      "assistant",
-		Content:   summary,
-		Meta:      "对话总结",
+	summary := out
+	newTitle := ""
+	if idx := strings.LastIndex(out, "标题："); idx != -1 {
+		summary = strings.TrimSpace(out[:idx])
+		newTitle = strings.TrimSpace(out[idx+len("标题："):])
 	}
-	db.Create(&summaryMsg)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"result": "success", "newTitle": newTitle})
+	return summary, newTitle, nil
 }
 
-func summarizeAndTitleByAI(personality, allText string) (string, string) {
-	prompt := fmt.Sprintf("你是一个AI助手，人格特点：%s。请总结以下对话内容，并用一句话（不超过20字）生成一个合适的标题。\n\n对话内容：\n%s\n\n请先输出对话总结，再输出标题（格式：总结\\n标题：xxxx）。", personality, allText)
-	reqBody := map[string]interface{}{
-		"model": model,
-		"messages": []map[string]string{
-			{"role": "user", "content": prompt},
-		},
-	}
-	jsonBody, _ := json.Marshal(reqBody)
-	req, err := http.NewRequest("POST", apiBaseURL, bytes.NewBuffer(jsonBody))
+// readUpload 读取multipart表单中名为field的文件，大小以upload.max_bytes为上限，超出时返回413；
+// 出错时已写好响应，what为提示中的文件类型
+func readUpload(w http.ResponseWriter, r *http.Request, field, what string) ([]byte, bool) {
+	tooLarge := func() {
+		http.Error(w, fmt.Sprintf("%s不能超过%dMB", what, cfg.Upload.MaxBytes>>20), http.StatusRequestEntityTooLarge)
+	}
+	// 留出multipart表单本身的开销
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Upload.MaxBytes+1<<20)
+	if err := r.ParseMultipartForm(cfg.Upload.MaxBytes); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			tooLarge()
+		} else {
+			http.Error(w, "文件上传失败", http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	file, _, err := r.FormFile(field)
 	if err != nil {
-		return "对话总结失败", ""
+		http.Error(w, "文件上传失败", http.StatusBadRequest)
+		return nil, false
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, cfg.Upload.MaxBytes+1))
 	if err != nil {
-		return "对话总结失败", ""
-	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return "对话总结失败", ""
-	}
-	var apiResp struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-	if err := json.Unmarshal(body, &apiResp); err != nil {
-		return "对话总结失败", ""
-	}
-	if len(apiResp.Choices) > 0 {
-		out := strings.TrimSpace(apiResp.Choices[0].Message.Content)
-		summary := out
-		newTitle := ""
-		if idx := strings.LastIndex(out, "标题："); idx != -1 {
-			summary = strings.TrimSpace(out[:idx])
-			newTitle = strings.TrimSpace(out[idx+len("标题："):])
-		}
-		return summary, newTitle
+		http.Error(w, "文件读取失败", http.StatusBadRequest)
+		return nil, false
 	}
-	return "对话总结失败", ""
+	if int64(len(data)) > cfg.Upload.MaxBytes {
+		tooLarge()
+		return nil, false
+	}
+	return data, true
 }
 
 func uploadAvatar(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(10 << 20)
-	file, handler, err := r.FormFile("avatar")
-	if err != nil {
-		http.Error(w, "文件上传失败", http.StatusBadRequest)
+	data, ok := readUpload(w, r, "avatar", "图片")
+	if !ok {
 		return
 	}
-	defer file.Close()
-	ext := filepath.Ext(handler.Filename)
-	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
-		http.Error(w, "仅支持PNG/JPG/JPEG", http.StatusBadRequest)
+	img, err := decodeAvatar(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	saveDir := "static/avatars"
-	os.MkdirAll(saveDir, 0755)
-	fileName := fmt.Sprintf("avatar_%d%s", time.Now().UnixNano(), ext)
-	savePath := filepath.Join(saveDir, fileName)
-	out, err := os.Create(savePath)
+	avatar, err := saveAvatar(img)
 	if err != nil {
 		http.Error(w, "文件保存失败", http.StatusInternalServerError)
 		return
 	}
-	defer out.Close()
-	io.Copy(out, file)
-	url := "/static/avatars/" + fileName
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(UploadAvatarResponse{Url: url})
+	json.NewEncoder(w).Encode(UploadAvatarResponse{Url: avatar.URL, ThumbUrl: avatar.ThumbURL})
 }
 
+// getSessions 按创建时间从新到旧分页：before=会话ID 取更早的会话，after=会话ID 取更新的会话
 func getSessions(w http.ResponseWriter, r *http.Request) {
+	p, err := parsePageParams(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userID := currentUserID(r)
+	// Session让base可以被多次复用而不互相污染条件
+	base := db.Model(&Session{}).Where("user_id = ?", userID).Session(&gorm.Session{})
+	var total int64
+	if err := base.Count(&total).Error; err != nil {
+		http.Error(w, "获取会话失败", http.StatusInternalServerError)
+		return
+	}
+
+	query := base.Order("created_at desc").Order("id desc")
+	if cursorID := p.Before + p.After; cursorID != "" {
+		cursor, err := findSession(userID, cursorID)
+		if err != nil {
+			http.Error(w, "游标会话不存在", http.StatusBadRequest)
+			return
+		}
+		if p.Before != "" {
+			query = query.Where("created_at < ? OR (created_at = ? AND id < ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+		} else {
+			// 取紧挨游标的更新会话，查询时正序，返回前再翻转
+			query = base.Where("created_at > ? OR (created_at = ? AND id > ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.ID).
+				Order("created_at asc").Order("id asc")
+		}
+	}
 	var sessions []Session
-	if err := db.Order("created_at desc").Find(&sessions).Error; err != nil {
+	if err := query.Limit(p.Limit + 1).Find(&sessions).Error; err != nil {
 		http.Error(w, "获取会话失败", http.StatusInternalServerError)
 		return
 	}
+	hasMore := len(sessions) > p.Limit
+	if hasMore {
+		sessions = sessions[:p.Limit]
+	}
+	if p.After != "" {
+		for i, j := 0, len(sessions)-1; i < j; i, j = i+1, j-1 {
+			sessions[i], sessions[j] = sessions[j], sessions[i]
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(sessions)
+	json.NewEncoder(w).Encode(Page{Items: sessions, Total: total, HasMore: hasMore})
 }
 
 func getMessages(w http.ResponseWriter, r *http.Request) {
@@ -582,13 +859,46 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "缺少sessionId参数", http.StatusBadRequest)
 		return
 	}
-	var msgs []Message
-	if err := db.Where("session_id = ?", sessionID).Order("created_at asc").Find(&msgs).Error; err != nil {
+	session, err := findSession(currentUserID(r), sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	p, err := parsePageParams(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 只返回当前分支，其他分支通过Siblings切换
+	tree, err := loadMessageTree(sessionID)
+	if err != nil {
 		http.Error(w, "获取消息失败", http.StatusInternalServerError)
 		return
 	}
+	ids := tree.pathIDs(session.HeadMessageID)
+	page, hasMore, err := pageIDs(ids, p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msgs := make([]Message, 0, len(page))
+	if len(page) > 0 {
+		var rows []Message
+		if err := db.Where("id IN ?", page).Find(&rows).Error; err != nil {
+			http.Error(w, "获取消息失败", http.StatusInternalServerError)
+			return
+		}
+		byID := make(map[uint]Message, len(rows))
+		for _, m := range rows {
+			byID[m.ID] = m
+		}
+		for _, id := range page {
+			msgs = append(msgs, byID[id])
+		}
+	}
+	tree.fillSiblings(msgs)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(msgs)
+	json.NewEncoder(w).Encode(Page{Items: msgs, Total: int64(len(ids)), HasMore: hasMore})
 }
 
 func deleteSession(w http.ResponseWriter, r *http.Request) {
@@ -597,14 +907,27 @@ func deleteSession(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "参数错误", http.StatusBadRequest)
 		return
 	}
+	if _, err := findSession(currentUserID(r), req.SessionID); err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
 	if err := db.Where("session_id = ?", req.SessionID).Delete(&Message{}).Error; err != nil {
 		http.Error(w, "消息删除失败", http.StatusInternalServerError)
 		return
 	}
+	if err := db.Where("session_id = ?", req.SessionID).Delete(&SessionSummary{}).Error; err != nil {
+		http.Error(w, "摘要删除失败", http.StatusInternalServerError)
+		return
+	}
+	if err := db.Where("session_id = ?", req.SessionID).Delete(&SessionMember{}).Error; err != nil {
+		http.Error(w, "成员删除失败", http.StatusInternalServerError)
+		return
+	}
 	if err := db.Where("id = ?", req.SessionID).Delete(&Session{}).Error; err != nil {
 		http.Error(w, "会话删除失败", http.StatusInternalServerError)
 		return
 	}
+	events.publish(currentUserID(r), Event{Type: eventSessionDeleted, SessionID: req.SessionID})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"result": "success"})
 }
@@ -615,142 +938,38 @@ func renameSession(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "参数错误", http.StatusBadRequest)
 		return
 	}
-	if err := db.Model(&Session{}).Where("id = ?", req.SessionID).Update("name", req.NewName).Error; err != nil {
+	if _, err := findSession(currentUserID(r), req.SessionID); err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err := db.Model(&Session{}).Where("id = ?", req.SessionID).Updates(map[string]interface{}{"name": req.NewName, "name_before_end": ""}).Error; err != nil {
 		http.Error(w, "重命名失败", http.StatusInternalServerError)
 		return
 	}
+	events.publish(currentUserID(r), Event{Type: eventSessionRenamed, SessionID: req.SessionID, Name: req.NewName})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"result": "success"})
 }
 
-func generateTitleByAI(personality, firstMsg string) string {
+func generateTitleByAI(session Session, personality, firstMsg string) (string, error) {
 	prompt := "你是一个AI助手，用户的人格特点是：" + personality + "。用户的对话主题如下：" + firstMsg + "。请用一句话（不超过20字）为本次对话生成一个简洁、准确的标题。直接返回标题，不要多余的话。"
-	reqBody := map[string]interface{}{
-		"model": model,
-		"messages": []map[string]string{
-			{"role": "user", "content": prompt},
-		},
-	}
-	jsonBody, _ := json.Marshal(reqBody)
-	req, err := http.NewRequest("POST", apiBaseURL, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return ""
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	client := &http.Client{Timeout: 20 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return ""
-	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return ""
-	}
-	var apiResp struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-	if err := json.Unmarshal(body, &apiResp); err != nil {
-		return ""
-	}
-	if len(apiResp.Choices) > 0 {
-		return strings.TrimSpace(apiResp.Choices[0].Message.Content)
-	}
-	return ""
+	return completeText(session, usageTitle, prompt, cfg.Timeouts.Title.Duration)
 }
 
 func generateSessionID() string {
 	return fmt.Sprintf("session_%d", time.Now().UnixNano())
 }
-func buildSystemMessage(modelName, personality string) string {
-	systemMsg := fmt.Sprintf("你是一个名为%s的AI助手。", modelName)
-	if personality != "" {
-		systemMsg += fmt.Sprintf(" 你的人格特点是: %s", personality)
-	}
-	systemMsg += " 请简洁、准确地回答用户的问题。"
-	return systemMsg
-}
-func callDeepseekAPI(messages []struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}) (*struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int    `json:"created"`
-	Choices []struct {
-		Index   int `json:"index"`
-		Message struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		} `json:"message"`
-		FinishReason string `json:"finish_reason"`
-	} `json:"choices"`
-	Usage struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
-}, error) {
-	requestBody := struct {
-		Model    string `json:"model"`
-		Messages []struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		} `json:"messages"`
-	}{
-		Model:    model,
+
+// callChatModel 用会话选择的模型和生成参数完成一轮对话
+func callChatModel(session Session, messages []ChatMessage) (*CompletionResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Chat.Duration)
+	defer cancel()
+	m := modelFor(session)
+	return m.provider.Complete(ctx, CompletionRequest{
+		Model:    m.Model,
 		Messages: messages,
-	}
-	jsonBody, err := json.Marshal(requestBody)
-	if err != nil {
-		return nil, err
-	}
-	req, err := http.NewRequest("POST", apiBaseURL, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API返回错误状态码: %d, 响应: %s", resp.StatusCode, string(body))
-	}
-	var response struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int    `json:"created"`
-		Choices []struct {
-			Index   int `json:"index"`
-			Message struct {
-				Role    string `json:"role"`
-				Content string `json:"content"`
-			} `json:"message"`
-			FinishReason string `json:"finish_reason"`
-		} `json:"choices"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
-	}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("解析响应失败: %v, 响应内容: %s", err, string(body))
-	}
-	return &response, nil
+		Params:   sessionParams(session),
+	})
 }
 func formatDuration(d time.Duration) string {
 	if d < time.Second {
@@ -761,7 +980,7 @@ func formatDuration(d time.Duration) string {
 
 func getPersonas(w http.ResponseWriter, r *http.Request) {
 	var personas []Persona
-	if err := db.Order("created_at desc").Find(&personas).Error; err != nil {
+	if err := db.Where("user_id = ?", currentUserID(r)).Order("created_at desc").Find(&personas).Error; err != nil {
 		http.Error(w, "获取人格失败", http.StatusInternalServerError)
 		return
 	}
@@ -779,31 +998,80 @@ func createOrUpdatePersona(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "名称不能为空", http.StatusBadRequest)
 		return
 	}
+	if err := data.Params.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validatePromptTemplate(data.PromptTemplate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 归属以登录用户为准，忽略请求体中的user_id
+	userID := currentUserID(r)
+	data.UserID = &userID
 	now := time.Now()
 	if data.ID > 0 {
+		var existing Persona
+		if err := db.Where("id = ? AND user_id = ?", data.ID, userID).First(&existing).Error; err != nil {
+			http.Error(w, "未找到该人格", http.StatusNotFound)
+			return
+		}
 		data.UpdatedAt = now
-		if err := db.Model(&Persona{}).Where("id=?", data.ID).Updates(data).Error; err != nil {
+		// 版本号由服务端维护
+		data.Version = 0
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&Persona{}).Where("id=?", data.ID).Updates(data).Error; err != nil {
+				return err
+			}
+			// Updates会跳过空值，生成参数和模板单独按列更新，才能恢复为默认
+			columns := append([]string{"prompt_template"}, generationParamColumns...)
+			if err := tx.Model(&Persona{}).Where("id=?", data.ID).Select(columns).Updates(&Persona{Params: data.Params, PromptTemplate: data.PromptTemplate}).Error; err != nil {
+				return err
+			}
+			rev, err := recordPersonaRevision(tx, data.ID, nil)
+			data.Version = rev.Version
+			return err
+		})
+		if err != nil {
 			http.Error(w, "更新失败", http.StatusInternalServerError)
 			return
 		}
 	} else {
 		data.CreatedAt = now
 		data.UpdatedAt = now
-		if err := db.Create(&data).Error; err != nil {
+		data.Version = 0
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&data).Error; err != nil {
+				return err
+			}
+			rev, err := recordPersonaRevision(tx, data.ID, nil)
+			data.Version = rev.Version
+			return err
+		})
+		if err != nil {
 			http.Error(w, "创建失败", http.StatusInternalServerError)
 			return
 		}
 	}
+	events.publish(userID, Event{Type: eventPersonaChanged, PersonaID: data.ID, Name: data.Name})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"result": "success", "persona": data})
 }
 
 func deletePersona(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	if err := db.Delete(&Persona{}, id).Error; err != nil {
+	res := db.Where("user_id = ?", currentUserID(r)).Delete(&Persona{}, id)
+	if res.Error != nil {
 		http.Error(w, "删除失败", http.StatusInternalServerError)
 		return
 	}
+	if res.RowsAffected == 0 {
+		http.Error(w, "未找到该人格", http.StatusNotFound)
+		return
+	}
+	if pid, err := strconv.ParseUint(id, 10, 64); err == nil {
+		events.publish(currentUserID(r), Event{Type: eventPersonaDeleted, PersonaID: uint(pid)})
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"result": "success"})
 }
@@ -817,17 +1085,39 @@ func usePersonaForSession(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "参数错误", http.StatusBadRequest)
 		return
 	}
+	userID := currentUserID(r)
+	if _, err := findSession(userID, req.SessionID); err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
 	var persona Persona
-	if err := db.First(&persona, req.PersonaID).Error; err != nil {
+	if err := db.Where("user_id = ?", userID).First(&persona, req.PersonaID).Error; err != nil {
 		http.Error(w, "人格不存在", http.StatusBadRequest)
 		return
 	}
-	db.Model(&Session{}).Where("id=?", req.SessionID).Updates(map[string]interface{}{
-		"personality": persona.Personality,
-		"ai_name":     persona.Name,
-		"ai_avatar":   persona.Avatar,
-		"persona_id":  persona.ID,
+	// 群聊切换到单个人格后不再是群聊；会话固定到该人格的最新版本
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_id = ?", req.SessionID).Delete(&SessionMember{}).Error; err != nil {
+			return err
+		}
+		revID, err := latestRevisionID(tx, persona.ID)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Session{}).Where("id=?", req.SessionID).Updates(map[string]interface{}{
+			"personality":         persona.Personality,
+			"ai_name":             persona.Name,
+			"ai_avatar":           persona.Avatar,
+			"persona_id":          persona.ID,
+			"persona_revision_id": *revID,
+			"turn_mode":           "",
+		}).Error
 	})
+	if err != nil {
+		http.Error(w, "切换人格失败", http.StatusInternalServerError)
+		return
+	}
+	events.publish(userID, Event{Type: eventSessionUpdated, SessionID: req.SessionID})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"result": "success"})
 }
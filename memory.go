@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionSummary 会话的滚动摘要：覆盖 UpToMessageID 及之前的全部消息，
+// 构造上下文时用它代替这些原始消息。每次滚动生成一条新记录，最新一条生效
+type SessionSummary struct {
+	ID            uint      `gorm:"primaryKey;size:32" json:"id"`
+	SessionID     string    `gorm:"type:varchar(64);index" json:"session_id"`
+	Content       string    `gorm:"type:text" json:"content"`
+	UpToMessageID uint      `gorm:"size:32" json:"up_to_message_id"`
+	MessageCount  int       `json:"message_count"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// summarizing 正在生成摘要的会话，避免同一会话并发滚动
+var summarizing sync.Map
+
+// summaryOnPath 取覆盖位置在该分支上的最新摘要，返回摘要和其后尚未被覆盖的消息；
+// 编辑或重新生成产生的新分支不会用到只属于旧分支的摘要
+func summaryOnPath(sessionID string, path []Message) (*SessionSummary, []Message) {
+	var summaries []SessionSummary
+	if err := db.Where("session_id = ?", sessionID).Order("up_to_message_id desc").Find(&summaries).Error; err != nil {
+		return nil, path
+	}
+	pos := make(map[uint]int, len(path))
+	for i, m := range path {
+		pos[m.ID] = i
+	}
+	for i := range summaries {
+		if idx, ok := pos[summaries[i].UpToMessageID]; ok {
+			return &summaries[i], path[idx+1:]
+		}
+	}
+	return nil, path
+}
+
+func summaryPrompt(summary string) string {
+	return "以下是此前对话的摘要，请把它当作你已经知道的内容：\n" + summary
+}
+
+// unsummarized 重新读取会话，取当前分支上的最新摘要和其后尚未被覆盖的对话消息
+func unsummarized(session *Session) (*SessionSummary, []Message, error) {
+	// 取回复保存后的分支位置
+	if err := db.Where("id = ?", session.ID).First(session).Error; err != nil {
+		return nil, nil, err
+	}
+	path, err := activePath(*session)
+	if err != nil {
+		return nil, nil, err
+	}
+	prev, rest := summaryOnPath(session.ID, path)
+	var msgs []Message
+	for _, m := range rest {
+		if m.Role != "system" {
+			msgs = append(msgs, m)
+		}
+	}
+	return prev, msgs, nil
+}
+
+// memoryDue 未被摘要覆盖的对话是否已达到滚动阈值
+func memoryDue(session Session) bool {
+	_, msgs, err := unsummarized(&session)
+	return err == nil && len(msgs) >= cfg.Memory.TriggerMessages
+}
+
+// rollSummary 当前分支上未被摘要覆盖的对话超过阈值时，把除最近 keep_recent 条以外的部分并入摘要
+func rollSummary(session Session) error {
+	prev, msgs, err := unsummarized(&session)
+	if err != nil {
+		return err
+	}
+	prevText := ""
+	if prev != nil {
+		prevText = prev.Content
+	}
+	if len(msgs) < cfg.Memory.TriggerMessages {
+		return nil
+	}
+	fold := msgs[:len(msgs)-cfg.Memory.KeepRecent]
+	if len(fold) == 0 {
+		return nil
+	}
+	// 保留部分从用户消息开始，与上下文裁剪规则一致
+	for len(fold) < len(msgs) && msgs[len(fold)].Role != "user" {
+		fold = msgs[:len(fold)+1]
+	}
+
+	var lines []string
+	for _, m := range fold {
+		lines = append(lines, fmt.Sprintf("[%s]: %s", transcriptRole(m), m.Content))
+	}
+	content, err := summarizeForMemory(session, sessionPersonality(session), prevText, strings.Join(lines, "\n"))
+	if err != nil {
+		return err
+	}
+	count := len(fold)
+	if prev != nil {
+		count += prev.MessageCount
+	}
+	return db.Create(&SessionSummary{
+		SessionID:     session.ID,
+		Content:       content,
+		UpToMessageID: fold[len(fold)-1].ID,
+		MessageCount:  count,
+	}).Error
+}
+
+func summarizeForMemory(session Session, personality, prevSummary, newText string) (string, error) {
+	if prevSummary == "" {
+		prevSummary = "（无）"
+	}
+	prompt := fmt.Sprintf("你是一个AI助手，人格特点：%s。下面是此前对话的摘要以及之后新增的对话，请把它们合并成一份新的摘要，保留人物、发生的事件、用户的偏好和尚未结束的话题等关键信息，不超过300字。直接输出摘要，不要多余的话。\n\n已有摘要：\n%s\n\n新增对话：\n%s", personality, prevSummary, newText)
+	out, err := completeText(session, usageMemory, prompt, cfg.Timeouts.Summary.Duration)
+	if err != nil {
+		return "", err
+	}
+	if out == "" {
+		return "", fmt.Errorf("模型返回的摘要为空")
+	}
+	return out, nil
+}
+
+// getSessionSummaries 按时间倒序返回会话的全部摘要版本
+func getSessionSummaries(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("sessionId")
+	if sessionID == "" {
+		http.Error(w, "缺少sessionId参数", http.StatusBadRequest)
+		return
+	}
+	if _, err := findSession(currentUserID(r), sessionID); err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	var summaries []SessionSummary
+	if err := db.Where("session_id = ?", sessionID).Order("up_to_message_id desc").Find(&summaries).Error; err != nil {
+		http.Error(w, "获取摘要失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
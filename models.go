@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// 可用模型由配置中的models列表注册，每个会话在Model字段记录所选模型的名称，
+// 对话、标题、总结等调用都使用会话自己的模型；会话记录的模型不在注册表中时使用默认模型
+
+// registeredModel 注册表中的模型及其后端，每个模型有独立的重试和熔断状态
+type registeredModel struct {
+	ModelConfig
+	provider LLMProvider
+}
+
+// contextWindow 配置了上下文长度时以配置为准，否则按模型ID前缀匹配
+func (m *registeredModel) contextWindow() int {
+	if m.ContextWindow > 0 {
+		return m.ContextWindow
+	}
+	return contextWindowFor(m.Model)
+}
+
+// models 第一项为默认模型
+var models []*registeredModel
+
+// initModels 按配置创建每个模型的后端
+func initModels(c *Config) error {
+	var out []*registeredModel
+	for _, mc := range c.modelConfigs() {
+		p, err := newProvider(mc.Provider, mc.BaseURL, mc.APIKey)
+		if err != nil {
+			return fmt.Errorf("模型%s: %w", mc.Name, err)
+		}
+		out = append(out, &registeredModel{
+			ModelConfig: mc,
+			provider:    newResilientProvider(p, c.LLM.Retry, c.LLM.CircuitBreaker),
+		})
+	}
+	models = out
+	return nil
+}
+
+// findModel 按名称查找模型，忽略大小写
+func findModel(name string) (*registeredModel, bool) {
+	for _, m := range models {
+		if strings.EqualFold(m.Name, strings.TrimSpace(name)) {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// modelFor 会话实际使用的模型
+func modelFor(session Session) *registeredModel {
+	if m, ok := findModel(session.Model); ok {
+		return m
+	}
+	return models[0]
+}
+
+// ModelInfo 返回给前端的模型信息，不含地址和密钥
+type ModelInfo struct {
+	Name          string   `json:"name"`
+	Provider      string   `json:"provider"`
+	ContextWindow int      `json:"contextWindow"`
+	Capabilities  []string `json:"capabilities"`
+	Default       bool     `json:"default"`
+}
+
+func handleListModels(w http.ResponseWriter, r *http.Request) {
+	list := make([]ModelInfo, 0, len(models))
+	for i, m := range models {
+		list = append(list, ModelInfo{
+			Name:          m.Name,
+			Provider:      m.Provider,
+			ContextWindow: m.contextWindow(),
+			Capabilities:  m.Capabilities,
+			Default:       i == 0,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+type SwitchModelRequest struct {
+	SessionID string `json:"sessionId"`
+	Model     string `json:"model"`
+}
+
+// switchSessionModel 对话中途切换模型，之后的回复、标题和总结都使用新模型
+func switchSessionModel(w http.ResponseWriter, r *http.Request) {
+	var req SwitchModelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" || req.Model == "" {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	session, ok := loadActiveSession(w, currentUserID(r), req.SessionID)
+	if !ok {
+		return
+	}
+	m, ok := findModel(req.Model)
+	if !ok {
+		http.Error(w, "模型不存在", http.StatusBadRequest)
+		return
+	}
+	if err := db.Model(&Session{}).Where("id = ?", session.ID).Update("model", m.Name).Error; err != nil {
+		http.Error(w, "切换模型失败", http.StatusInternalServerError)
+		return
+	}
+	session.Model = m.Name
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result":  "success",
+		"model":   m.Name,
+		"context": budgetForSession(session),
+	})
+}
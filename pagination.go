@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// pageParams 游标分页参数：before/after 为游标项的ID（二选一），limit 为每页条数，
+// order=desc 时结果从新到旧排列
+type pageParams struct {
+	Before string
+	After  string
+	Limit  int
+	Desc   bool
+}
+
+// Page 分页接口的统一返回结构，HasMore 表示沿本次翻页方向是否还有数据
+type Page struct {
+	Items   interface{} `json:"items"`
+	Total   int64       `json:"total"`
+	HasMore bool        `json:"hasMore"`
+}
+
+func parsePageParams(r *http.Request, defaultDesc bool) (pageParams, error) {
+	q := r.URL.Query()
+	p := pageParams{
+		Before: q.Get("before"),
+		After:  q.Get("after"),
+		Limit:  defaultPageLimit,
+		Desc:   defaultDesc,
+	}
+	if p.Before != "" && p.After != "" {
+		return p, fmt.Errorf("before和after不能同时使用")
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return p, fmt.Errorf("limit必须是正整数")
+		}
+		if n > maxPageLimit {
+			n = maxPageLimit
+		}
+		p.Limit = n
+	}
+	switch q.Get("order") {
+	case "":
+	case "asc":
+		p.Desc = false
+	case "desc":
+		p.Desc = true
+	default:
+		return p, fmt.Errorf("order只能是asc或desc")
+	}
+	return p, nil
+}
+
+// pageIDs 在按时间顺序排列的ID中取一页：有游标时取紧挨游标的limit条，
+// 没有游标时正序从最早开始、倒序从最新开始
+func pageIDs(ids []uint, p pageParams) ([]uint, bool, error) {
+	rng := ids
+	if cursor := p.Before + p.After; cursor != "" {
+		id, err := strconv.ParseUint(cursor, 10, 32)
+		if err != nil {
+			return nil, false, fmt.Errorf("游标格式错误")
+		}
+		idx := -1
+		for i, v := range ids {
+			if v == uint(id) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, false, fmt.Errorf("游标消息不在当前分支上")
+		}
+		if p.Before != "" {
+			rng = ids[:idx]
+		} else {
+			rng = ids[idx+1:]
+		}
+	}
+
+	var page []uint
+	var hasMore bool
+	if p.Before != "" || (p.After == "" && p.Desc) {
+		start := len(rng) - p.Limit
+		if start < 0 {
+			start = 0
+		}
+		page, hasMore = rng[start:], start > 0
+	} else {
+		end := p.Limit
+		if end > len(rng) {
+			end = len(rng)
+		}
+		page, hasMore = rng[:end], end < len(rng)
+	}
+	out := make([]uint, len(page))
+	copy(out, page)
+	if p.Desc {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	return out, hasMore, nil
+}
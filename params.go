@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxStopSequences OpenAI最多接受4个停止序列
+const maxStopSequences = 4
+
+// GenerationParams 生成参数，字段为空表示使用模型默认值。人格上保存默认值，会话上保存覆盖值；
+// json字段名与OpenAI接口一致，OpenAI兼容后端直接内嵌发送
+type GenerationParams struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	MaxTokens        *int     `json:"max_tokens,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Stop             []string `gorm:"type:text;serializer:json" json:"stop,omitempty"`
+}
+
+// generationParamColumns 参数在personas、sessions表中的列，更新时显式指定以便能清空
+var generationParamColumns = []string{
+	"gen_temperature", "gen_top_p", "gen_max_tokens",
+	"gen_presence_penalty", "gen_frequency_penalty", "gen_stop",
+}
+
+func (p GenerationParams) Validate() error {
+	var errs []string
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		errs = append(errs, "temperature 应在0到2之间")
+	}
+	if p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1) {
+		errs = append(errs, "top_p 应大于0且不超过1")
+	}
+	if p.MaxTokens != nil && *p.MaxTokens < 1 {
+		errs = append(errs, "max_tokens 至少为1")
+	}
+	if p.PresencePenalty != nil && (*p.PresencePenalty < -2 || *p.PresencePenalty > 2) {
+		errs = append(errs, "presence_penalty 应在-2到2之间")
+	}
+	if p.FrequencyPenalty != nil && (*p.FrequencyPenalty < -2 || *p.FrequencyPenalty > 2) {
+		errs = append(errs, "frequency_penalty 应在-2到2之间")
+	}
+	if len(p.Stop) > maxStopSequences {
+		errs = append(errs, fmt.Sprintf("stop 最多%d个", maxStopSequences))
+	}
+	for _, s := range p.Stop {
+		if s == "" {
+			errs = append(errs, "stop 不能包含空字符串")
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("生成参数错误: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// merge 用o中设置了的字段覆盖p
+func (p GenerationParams) merge(o GenerationParams) GenerationParams {
+	if o.Temperature != nil {
+		p.Temperature = o.Temperature
+	}
+	if o.TopP != nil {
+		p.TopP = o.TopP
+	}
+	if o.MaxTokens != nil {
+		p.MaxTokens = o.MaxTokens
+	}
+	if o.PresencePenalty != nil {
+		p.PresencePenalty = o.PresencePenalty
+	}
+	if o.FrequencyPenalty != nil {
+		p.FrequencyPenalty = o.FrequencyPenalty
+	}
+	if o.Stop != nil {
+		p.Stop = o.Stop
+	}
+	return p
+}
+
+// sessionParams 会话实际使用的生成参数：所固定人格版本的默认值，再叠加会话自己的覆盖值
+func sessionParams(session Session) GenerationParams {
+	var params GenerationParams
+	if persona, ok := sessionPersona(session); ok {
+		params = persona.Params
+	}
+	return params.merge(session.Params)
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// 人格每次创建、修改、导入或回滚都追加一个不可变的版本。会话（以及群聊成员）固定在创建或
+// 升级时的版本上，之后修改人格不会改变已有会话的system prompt和生成参数，需要时手动升级
+
+// PersonaRevision 人格的一个版本，Version从1开始递增
+type PersonaRevision struct {
+	ID          uint     `gorm:"primaryKey;size:32" json:"id"`
+	PersonaID   uint     `gorm:"size:32;uniqueIndex:idx_persona_version" json:"persona_id"`
+	Persona     *Persona `gorm:"foreignKey:PersonaID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+	Version     int      `gorm:"uniqueIndex:idx_persona_version" json:"version"`
+	Name        string   `gorm:"type:varchar(64)" json:"name"`
+	Avatar      string   `gorm:"type:varchar(256)" json:"avatar"`
+	Identity    string   `gorm:"type:varchar(128)" json:"identity"`
+	Appearance  string   `gorm:"type:text" json:"appearance"`
+	Personality string   `gorm:"type:text" json:"personality"`
+	// PromptTemplate 该版本的system prompt模板
+	PromptTemplate string `gorm:"type:text" json:"prompt_template"`
+	// RolledBackFrom 由回滚产生时记录所回滚到的版本号
+	RolledBackFrom *int             `json:"rolled_back_from,omitempty"`
+	Params         GenerationParams `gorm:"embedded;embeddedPrefix:gen_" json:"params"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// persona 该版本的内容，ID为所属人格
+func (r PersonaRevision) persona() Persona {
+	return Persona{
+		ID:             r.PersonaID,
+		Name:           r.Name,
+		Avatar:         r.Avatar,
+		Identity:       r.Identity,
+		Appearance:     r.Appearance,
+		Personality:    r.Personality,
+		PromptTemplate: r.PromptTemplate,
+		Params:         r.Params,
+		Version:        r.Version,
+	}
+}
+
+// revisionField 参与比较的字段，生成参数整体按JSON比较
+type revisionField struct {
+	Name  string
+	Value string
+}
+
+func (r PersonaRevision) fields() []revisionField {
+	params, _ := json.Marshal(r.Params)
+	return []revisionField{
+		{"name", r.Name},
+		{"avatar", r.Avatar},
+		{"identity", r.Identity},
+		{"appearance", r.Appearance},
+		{"personality", r.Personality},
+		{"prompt_template", r.PromptTemplate},
+		{"params", string(params)},
+	}
+}
+
+func (r PersonaRevision) sameContent(o PersonaRevision) bool {
+	a, b := r.fields(), o.fields()
+	for i := range a {
+		if a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// recordPersonaRevision 按人格当前的内容追加一个版本；内容与最新版本相同且不是回滚时不重复记录
+func recordPersonaRevision(tx *gorm.DB, personaID uint, rolledBackFrom *int) (PersonaRevision, error) {
+	var p Persona
+	if err := tx.First(&p, personaID).Error; err != nil {
+		return PersonaRevision{}, err
+	}
+	rev := PersonaRevision{
+		PersonaID:      p.ID,
+		Name:           p.Name,
+		Avatar:         p.Avatar,
+		Identity:       p.Identity,
+		Appearance:     p.Appearance,
+		Personality:    p.Personality,
+		PromptTemplate: p.PromptTemplate,
+		Params:         p.Params,
+		RolledBackFrom: rolledBackFrom,
+	}
+	var latest PersonaRevision
+	err := tx.Where("persona_id = ?", personaID).Order("version desc").First(&latest).Error
+	switch {
+	case err == nil:
+		if rolledBackFrom == nil && latest.sameContent(rev) {
+			return latest, nil
+		}
+		rev.Version = latest.Version + 1
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		rev.Version = 1
+	default:
+		return PersonaRevision{}, err
+	}
+	if err := tx.Create(&rev).Error; err != nil {
+		return PersonaRevision{}, err
+	}
+	return rev, tx.Model(&Persona{}).Where("id = ?", personaID).UpdateColumn("version", rev.Version).Error
+}
+
+// latestRevisionID 人格最新版本的ID，用于把会话固定到当前版本
+func latestRevisionID(tx *gorm.DB, personaID uint) (*uint, error) {
+	var rev PersonaRevision
+	if err := tx.Select("id").Where("persona_id = ?", personaID).Order("version desc").First(&rev).Error; err != nil {
+		return nil, err
+	}
+	return &rev.ID, nil
+}
+
+// resolvePersona 取人格在某个版本的内容，revisionID为空时取当前内容
+func resolvePersona(personaID uint, revisionID *uint) (Persona, error) {
+	if revisionID != nil {
+		var rev PersonaRevision
+		err := db.Where("id = ? AND persona_id = ?", *revisionID, personaID).First(&rev).Error
+		if err == nil {
+			return rev.persona(), nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return Persona{}, err
+		}
+	}
+	var p Persona
+	err := db.First(&p, personaID).Error
+	return p, err
+}
+
+// sessionPersona 会话所固定版本的人格，未关联人格时返回false
+func sessionPersona(session Session) (Persona, bool) {
+	if session.PersonaID == nil || *session.PersonaID == 0 {
+		return Persona{}, false
+	}
+	p, err := resolvePersona(*session.PersonaID, session.PersonaRevisionID)
+	return p, err == nil
+}
+
+// backfillPersonaRevisions 升级前创建的人格补记第1版，已有会话和群聊成员固定到该版本
+func backfillPersonaRevisions(db *gorm.DB) error {
+	var ids []uint
+	if err := db.Model(&Persona{}).Where("version IS NULL OR version = 0").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := recordPersonaRevision(db, id, nil); err != nil {
+			return err
+		}
+	}
+	latest := "(SELECT r.id FROM persona_revisions r WHERE r.persona_id = %s.persona_id ORDER BY r.version DESC LIMIT 1)"
+	if err := db.Exec("UPDATE sessions SET persona_revision_id = " + fmt.Sprintf(latest, "sessions") +
+		" WHERE persona_id IS NOT NULL AND persona_revision_id IS NULL").Error; err != nil {
+		return err
+	}
+	return db.Exec("UPDATE session_members SET revision_id = " + fmt.Sprintf(latest, "session_members") +
+		" WHERE revision_id IS NULL").Error
+}
+
+// findUserPersona 按路由中的id查当前用户的人格，失败时已写出错误响应
+func findUserPersona(w http.ResponseWriter, r *http.Request) (Persona, bool) {
+	var p Persona
+	if err := db.Where("user_id = ?", currentUserID(r)).First(&p, mux.Vars(r)["id"]).Error; err != nil {
+		http.Error(w, "未找到该人格", http.StatusNotFound)
+		return p, false
+	}
+	return p, true
+}
+
+// getPersonaRevisions 按版本号倒序返回人格的全部版本
+func getPersonaRevisions(w http.ResponseWriter, r *http.Request) {
+	p, ok := findUserPersona(w, r)
+	if !ok {
+		return
+	}
+	var revs []PersonaRevision
+	if err := db.Where("persona_id = ?", p.ID).Order("version desc").Find(&revs).Error; err != nil {
+		http.Error(w, "获取版本失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revs)
+}
+
+// FieldDiff 一个字段在两个版本间的变化，文本字段附带逐行对比
+type FieldDiff struct {
+	Field string     `json:"field"`
+	From  string     `json:"from"`
+	To    string     `json:"to"`
+	Lines []DiffLine `json:"lines,omitempty"`
+}
+
+// DiffLine Op为 " "（未变）、"-"（删除）或 "+"（新增）
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// diffLines 基于最长公共子序列的逐行对比
+func diffLines(a, b []string) []DiffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var out []DiffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, DiffLine{" ", a[i]})
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, DiffLine{"-", a[i]})
+			i++
+		default:
+			out = append(out, DiffLine{"+", b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, DiffLine{"-", a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, DiffLine{"+", b[j]})
+	}
+	return out
+}
+
+// splitLines 空文本没有任何行，避免与空白版本对比时多出一行删除
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffRevisions 只列出有变化的字段
+func diffRevisions(from, to PersonaRevision) []FieldDiff {
+	a, b := from.fields(), to.fields()
+	diffs := []FieldDiff{}
+	for i := range a {
+		if a[i].Value == b[i].Value {
+			continue
+		}
+		d := FieldDiff{Field: a[i].Name, From: a[i].Value, To: b[i].Value}
+		if a[i].Name == "appearance" || a[i].Name == "personality" || a[i].Name == "prompt_template" {
+			d.Lines = diffLines(splitLines(a[i].Value), splitLines(b[i].Value))
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// getPersonaDiff 对比两个版本：from、to为版本号，to默认为最新版本，from默认为to的上一版
+func getPersonaDiff(w http.ResponseWriter, r *http.Request) {
+	p, ok := findUserPersona(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	to := p.Version
+	if v := q.Get("to"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "to格式错误", http.StatusBadRequest)
+			return
+		}
+		to = n
+	}
+	// 未指定from时与上一版本比较；第一版没有上一版本，与空白人格比较，全部显示为新增
+	from := to - 1
+	if v := q.Get("from"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "from格式错误", http.StatusBadRequest)
+			return
+		}
+		from = n
+	}
+	var revs []PersonaRevision
+	if err := db.Where("persona_id = ? AND version IN ?", p.ID, []int{from, to}).Find(&revs).Error; err != nil {
+		http.Error(w, "获取版本失败", http.StatusInternalServerError)
+		return
+	}
+	byVersion := make(map[int]PersonaRevision)
+	for _, rev := range revs {
+		byVersion[rev.Version] = rev
+	}
+	fromRev, ok1 := byVersion[from]
+	if from == 0 {
+		fromRev, ok1 = PersonaRevision{}, true
+	}
+	toRev, ok2 := byVersion[to]
+	if !ok1 || !ok2 {
+		http.Error(w, "版本不存在", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":    from,
+		"to":      to,
+		"changes": diffRevisions(fromRev, toRev),
+	})
+}
+
+// rollbackPersona 把人格恢复为某个历史版本的内容，作为新版本记录，历史版本本身不变
+func rollbackPersona(w http.ResponseWriter, r *http.Request) {
+	p, ok := findUserPersona(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version <= 0 {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	var target PersonaRevision
+	if err := db.Where("persona_id = ? AND version = ?", p.ID, req.Version).First(&target).Error; err != nil {
+		http.Error(w, "版本不存在", http.StatusNotFound)
+		return
+	}
+	var rev PersonaRevision
+	err := db.Transaction(func(tx *gorm.DB) error {
+		restored := target.persona()
+		restored.UpdatedAt = time.Now()
+		columns := append([]string{"name", "avatar", "identity", "appearance", "personality", "prompt_template", "updated_at"}, generationParamColumns...)
+		if err := tx.Model(&Persona{}).Where("id = ?", p.ID).Select(columns).Updates(&restored).Error; err != nil {
+			return err
+		}
+		var err error
+		rev, err = recordPersonaRevision(tx, p.ID, &req.Version)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "回滚失败", http.StatusInternalServerError)
+		return
+	}
+	events.publish(currentUserID(r), Event{Type: eventPersonaChanged, PersonaID: p.ID, Name: target.Name})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": "success", "revision": rev})
+}
+
+// PinnedPersona 会话中一个人格所固定的版本
+type PinnedPersona struct {
+	PersonaID     uint   `json:"personaId"`
+	Name          string `json:"name"`
+	Version       int    `json:"version"`
+	LatestVersion int    `json:"latestVersion"`
+}
+
+// sessionPinnedPersonas 会话（群聊为全部成员）固定的人格版本及其最新版本
+func sessionPinnedPersonas(session Session) ([]PinnedPersona, error) {
+	type ref struct {
+		personaID  uint
+		revisionID *uint
+	}
+	var refs []ref
+	if isGroup(session) {
+		var members []SessionMember
+		if err := db.Where("session_id = ?", session.ID).Order("position asc").Find(&members).Error; err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			refs = append(refs, ref{m.PersonaID, m.RevisionID})
+		}
+	} else if session.PersonaID != nil {
+		refs = append(refs, ref{*session.PersonaID, session.PersonaRevisionID})
+	}
+	out := []PinnedPersona{}
+	for _, rf := range refs {
+		var current Persona
+		if err := db.First(&current, rf.personaID).Error; err != nil {
+			continue
+		}
+		pinned, err := resolvePersona(rf.personaID, rf.revisionID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, PinnedPersona{
+			PersonaID:     rf.personaID,
+			Name:          pinned.Name,
+			Version:       pinned.Version,
+			LatestVersion: current.Version,
+		})
+	}
+	return out, nil
+}
+
+// getSessionPersonaRevision 查看会话固定的人格版本以及是否有可升级的新版本
+func getSessionPersonaRevision(w http.ResponseWriter, r *http.Request) {
+	session, err := findSession(currentUserID(r), r.URL.Query().Get("sessionId"))
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	pinned, err := sessionPinnedPersonas(session)
+	if err != nil {
+		http.Error(w, "获取人格版本失败", http.StatusInternalServerError)
+		return
+	}
+	upgradable := false
+	for _, p := range pinned {
+		if p.Version < p.LatestVersion {
+			upgradable = true
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"personas":         pinned,
+		"upgradeAvailable": upgradable,
+	})
+}
+
+// upgradeSessionPersona 把会话（群聊为全部成员）固定到人格的最新版本，之后的回复按新设定生成
+func upgradeSessionPersona(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	session, ok := loadActiveSession(w, currentUserID(r), req.SessionID)
+	if !ok {
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if isGroup(session) {
+			var members []SessionMember
+			if err := tx.Where("session_id = ?", session.ID).Order("position asc").Find(&members).Error; err != nil {
+				return err
+			}
+			var personas []Persona
+			for _, m := range members {
+				var p Persona
+				if err := tx.First(&p, m.PersonaID).Error; err != nil {
+					return err
+				}
+				personas = append(personas, p)
+			}
+			if len(personas) == 0 {
+				return nil
+			}
+			if err := replaceGroupMembers(tx, session.ID, personas); err != nil {
+				return err
+			}
+			name, avatar := groupDisplay(personas)
+			return tx.Model(&Session{}).Where("id = ?", session.ID).Updates(map[string]interface{}{"ai_name": name, "ai_avatar": avatar}).Error
+		}
+		if session.PersonaID == nil {
+			return nil
+		}
+		var p Persona
+		if err := tx.First(&p, *session.PersonaID).Error; err != nil {
+			return err
+		}
+		revID, err := latestRevisionID(tx, p.ID)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Session{}).Where("id = ?", session.ID).Updates(map[string]interface{}{
+			"persona_revision_id": *revID,
+			"personality":         p.Personality,
+			"ai_name":             p.Name,
+			"ai_avatar":           p.Avatar,
+		}).Error
+	})
+	if err != nil {
+		http.Error(w, "升级失败", http.StatusInternalServerError)
+		return
+	}
+	events.publish(currentUserID(r), Event{Type: eventSessionUpdated, SessionID: session.ID})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"result": "success"})
+}
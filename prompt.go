@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+)
+
+// 人格可以自定义system prompt模板，语法为Go text/template，变量只能通过下列函数取得：
+//   {{char}} 角色名  {{user}} 用户名  {{model}} 模型名  {{date}} 日期  {{time}} 时间
+//   {{identity}} 身份  {{appearance}} 外貌  {{personality}} 性格  {{original}} 默认模板的渲染结果
+// 写法与SillyTavern角色卡的{{char}}/{{user}}宏兼容，可以用{{if personality}}...{{end}}按需输出。
+// 模板为空时使用默认模板，与原先固定的提示词一致
+
+// defaultPersonaTemplate 关联人格的会话的默认模板
+const defaultPersonaTemplate = "你是一个名为{{char}}的AI助手。" +
+	"{{if identity}} 你的身份是：{{identity}}。{{end}}" +
+	"{{if appearance}} 你的外貌特征：{{appearance}}。{{end}}" +
+	"{{if personality}} 你的人格特点：{{personality}}。{{end}}" +
+	" 请简洁、准确地回答用户的问题。"
+
+// defaultCustomTemplate 直接填写性格、未关联人格的会话使用的模板
+const defaultCustomTemplate = "你是一个名为{{model}}的AI助手。" +
+	"{{if personality}} 你的人格特点是: {{personality}}{{end}}" +
+	" 请简洁、准确地回答用户的问题。"
+
+const (
+	maxPromptTemplateLen = 8000  // 模板最多字符数
+	maxPromptLen         = 64000 // 渲染结果最多字节数
+)
+
+// PromptVars 模板可用的变量
+type PromptVars struct {
+	Char        string
+	User        string
+	Model       string
+	Identity    string
+	Appearance  string
+	Personality string
+	Now         time.Time
+	// base 渲染{{original}}使用的默认模板
+	base string
+}
+
+func (v PromptVars) funcs() template.FuncMap {
+	return template.FuncMap{
+		"char":        func() string { return v.Char },
+		"user":        func() string { return v.User },
+		"model":       func() string { return v.Model },
+		"identity":    func() string { return v.Identity },
+		"appearance":  func() string { return v.Appearance },
+		"personality": func() string { return v.Personality },
+		"date":        func() string { return v.Now.Format("2006-01-02") },
+		"time":        func() string { return v.Now.Format("15:04") },
+		"original": func() (string, error) {
+			if v.base == "" {
+				return "", nil
+			}
+			return renderPrompt(v.base, PromptVars{Char: v.Char, User: v.User, Model: v.Model,
+				Identity: v.Identity, Appearance: v.Appearance, Personality: v.Personality, Now: v.Now})
+		},
+	}
+}
+
+// limitedBuffer 超过上限时报错，防止模板输出过大
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxPromptLen {
+		return 0, errors.New("提示词过长")
+	}
+	return b.Buffer.Write(p)
+}
+
+// parsePromptTemplate 只允许输出、条件和with，禁止range以及define/template，避免循环或递归展开
+func parsePromptTemplate(text string, funcs template.FuncMap) (*template.Template, error) {
+	if utf8.RuneCountInString(text) > maxPromptTemplateLen {
+		return nil, fmt.Errorf("提示词模板不能超过%d个字符", maxPromptTemplateLen)
+	}
+	t, err := template.New("prompt").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("提示词模板错误: %s", strings.TrimPrefix(err.Error(), "template: "))
+	}
+	if len(t.Templates()) > 1 {
+		return nil, errors.New("提示词模板不支持define/block")
+	}
+	if t.Tree != nil {
+		if err := checkPromptNode(t.Tree.Root); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func checkPromptNode(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := checkPromptNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkPipe(n.Pipe)
+	case *parse.IfNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.WithNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		return errors.New("提示词模板不支持range")
+	case *parse.TemplateNode:
+		return errors.New("提示词模板不支持template")
+	}
+	return nil
+}
+
+func checkBranch(b *parse.BranchNode) error {
+	if err := checkPipe(b.Pipe); err != nil {
+		return err
+	}
+	if err := checkPromptNode(b.List); err != nil {
+		return err
+	}
+	return checkPromptNode(b.ElseList)
+}
+
+// checkPipe 模板没有数据，.字段访问只会输出<no value>，直接报错
+func checkPipe(p *parse.PipeNode) error {
+	if p == nil {
+		return nil
+	}
+	for _, cmd := range p.Cmds {
+		for _, arg := range cmd.Args {
+			switch a := arg.(type) {
+			case *parse.FieldNode, *parse.ChainNode:
+				return fmt.Errorf("提示词模板不支持%s，请使用{{char}}等变量", a)
+			case *parse.PipeNode:
+				if err := checkPipe(a); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// renderPrompt 渲染模板，模板中不能通过.访问数据
+func renderPrompt(text string, v PromptVars) (string, error) {
+	t, err := parsePromptTemplate(text, v.funcs())
+	if err != nil {
+		return "", err
+	}
+	var buf limitedBuffer
+	if err := t.Execute(&buf, nil); err != nil {
+		return "", fmt.Errorf("提示词模板错误: %s", strings.TrimPrefix(err.Error(), "template: "))
+	}
+	return buf.String(), nil
+}
+
+// validatePromptTemplate 保存人格前用示例变量试渲染一次
+func validatePromptTemplate(text string) error {
+	if text == "" {
+		return nil
+	}
+	_, err := renderPrompt(text, PromptVars{
+		Char: "角色", User: "用户", Model: "model", Identity: "身份", Appearance: "外貌", Personality: "性格",
+		Now: time.Now(), base: defaultPersonaTemplate,
+	})
+	return err
+}
+
+// promptVarsFor 会话的公共变量：登录用户名、会话模型和当前时间
+func promptVarsFor(session Session) PromptVars {
+	v := PromptVars{Model: session.Model, Now: time.Now()}
+	if session.UserID != nil {
+		var u User
+		if err := db.Select("username").First(&u, *session.UserID).Error; err == nil {
+			v.User = u.Username
+		}
+	}
+	return v
+}
+
+// buildSystemMessageFromPersona 按人格的模板生成system prompt，模板渲染失败时退回默认模板
+func buildSystemMessageFromPersona(p Persona, session Session) string {
+	v := promptVarsFor(session)
+	v.Char, v.Identity, v.Appearance, v.Personality = p.Name, p.Identity, p.Appearance, p.Personality
+	v.base = defaultPersonaTemplate
+	if p.PromptTemplate != "" {
+		out, err := renderPrompt(p.PromptTemplate, v)
+		if err == nil {
+			return out
+		}
+		log.Printf("人格%d的提示词模板渲染失败，使用默认模板: %v", p.ID, err)
+	}
+	out, _ := renderPrompt(defaultPersonaTemplate, v)
+	return out
+}
+
+// buildSystemMessage 未关联人格的会话，沿用以模型名称作为助手名的默认提示词
+func buildSystemMessage(session Session) string {
+	v := promptVarsFor(session)
+	v.Char, v.Personality = session.AIName, session.Personality
+	out, _ := renderPrompt(defaultCustomTemplate, v)
+	return out
+}
+
+// PromptPreviewRequest 按编辑中的人格内容预览，无需先保存
+type PromptPreviewRequest struct {
+	Persona
+	SessionID string `json:"sessionId"`
+}
+
+// previewPrompt 渲染最终的system prompt；指定会话时使用该会话的模型
+func previewPrompt(w http.ResponseWriter, r *http.Request) {
+	var req PromptPreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	userID := currentUserID(r)
+	session := Session{Model: models[0].Name, UserID: &userID}
+	if req.SessionID != "" {
+		if err := db.Where("id = ? AND user_id = ?", req.SessionID, userID).First(&session).Error; err != nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+	}
+	if err := validatePromptTemplate(req.PromptTemplate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"prompt":          buildSystemMessageFromPersona(req.Persona, session),
+		"defaultTemplate": defaultPersonaTemplate,
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChatMessage 发送给模型的一条消息
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// CompletionRequest 一次对话补全请求，与具体后端无关
+type CompletionRequest struct {
+	Model    string
+	Messages []ChatMessage
+	// Params 生成参数，各后端按自己支持的字段转换，不支持的忽略
+	Params GenerationParams
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// CompletionResult 各后端统一后的返回结果
+type CompletionResult struct {
+	Content      string `json:"content"`
+	FinishReason string `json:"finish_reason"`
+	Usage        Usage  `json:"usage"`
+}
+
+// LLMProvider 大模型后端接口，OpenAI兼容、Anthropic、Ollama以及进程内假后端都实现它
+type LLMProvider interface {
+	Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error)
+	// Stream 流式补全，每收到一段增量文本调用一次onDelta，结束后返回拼接好的完整结果
+	Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResult, error)
+}
+
+// APIError 上游返回非200状态码
+type APIError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter 上游通过Retry-After要求等待的时间，没有时为0
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API返回错误状态码: %d, 响应: %s", e.StatusCode, e.Body)
+}
+
+// newProvider 按名称创建模型后端，endpoint为完整的接口地址
+func newProvider(kind, endpoint, key string) (LLMProvider, error) {
+	switch strings.ToLower(kind) {
+	case "", "openai":
+		return &openAIProvider{endpoint: endpoint, apiKey: key, client: &http.Client{}}, nil
+	case "anthropic":
+		return &anthropicProvider{endpoint: endpoint, apiKey: key, client: &http.Client{}}, nil
+	case "ollama":
+		return &ollamaProvider{endpoint: endpoint, apiKey: key, client: &http.Client{}}, nil
+	case "fake":
+		return &fakeProvider{}, nil
+	}
+	return nil, fmt.Errorf("未知的模型后端: %s", kind)
+}
+
+// doPost 发送JSON请求，非200状态码时读出响应体并返回APIError
+func doPost(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, in interface{}) (*http.Response, error) {
+	jsonBody, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: string(body), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return resp, nil
+}
+
+// parseRetryAfter Retry-After可以是秒数或HTTP日期
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// postJSON 发送JSON请求并把响应解析到out，超时由ctx控制
+func postJSON(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, in, out interface{}) error {
+	resp, err := doPost(ctx, client, endpoint, headers, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("解析响应失败: %v, 响应内容: %s", err, string(body))
+	}
+	return nil
+}
+
+// postStream 发送流式请求，返回响应体，由调用方负责关闭
+func postStream(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, in interface{}) (io.ReadCloser, error) {
+	resp, err := doPost(ctx, client, endpoint, headers, in)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// readSSE 逐个解析上游的Server-Sent Events，event为空表示默认的message事件
+func readSSE(r io.Reader, fn func(event, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				if err := fn(event, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// 注释/心跳
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		return fn(event, strings.Join(data, "\n"))
+	}
+	return nil
+}
+
+// completeText 用会话的模型单轮提问，用于退出意图、标题、总结等辅助调用，用量按kind记在会话名下
+func completeText(session Session, kind, prompt string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	m := modelFor(session)
+	res, err := m.provider.Complete(ctx, CompletionRequest{
+		Model:    m.Model,
+		Messages: []ChatMessage{{Role: "user", Content: prompt}},
+	})
+	if err != nil {
+		return "", err
+	}
+	recordUsage(session, kind, m.Model, nil, res.Usage, time.Since(start))
+	return strings.TrimSpace(res.Content), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicVersion   = "2023-06-01"
+	anthropicMaxTokens = 1024
+)
+
+// anthropicProvider Anthropic Messages接口，endpoint为 /v1/messages 完整地址
+type anthropicProvider struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+}
+
+type anthropicRequest struct {
+	Model         string        `json:"model"`
+	System        string        `json:"system,omitempty"`
+	Messages      []ChatMessage `json:"messages"`
+	MaxTokens     int           `json:"max_tokens"`
+	Stream        bool          `json:"stream,omitempty"`
+	Temperature   *float64      `json:"temperature,omitempty"`
+	TopP          *float64      `json:"top_p,omitempty"`
+	StopSequences []string      `json:"stop_sequences,omitempty"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+func (p *anthropicProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	body := p.buildRequest(req)
+	var resp anthropicResponse
+	if err := postJSON(ctx, p.client, p.endpoint, p.headers(), body, &resp); err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	for _, c := range resp.Content {
+		if c.Type == "text" {
+			sb.WriteString(c.Text)
+		}
+	}
+	if sb.Len() == 0 {
+		return nil, errors.New("API返回结果为空")
+	}
+	return &CompletionResult{
+		Content:      sb.String(),
+		FinishReason: resp.StopReason,
+		Usage: Usage{
+			PromptTokens:     resp.Usage.InputTokens,
+			CompletionTokens: resp.Usage.OutputTokens,
+			TotalTokens:      resp.Usage.InputTokens + resp.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+// anthropicStreamEvent 流式事件，不同type只会用到其中部分字段
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage struct {
+			InputTokens int `json:"input_tokens"`
+		} `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *anthropicProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResult, error) {
+	body := p.buildRequest(req)
+	body.Stream = true
+	stream, err := postStream(ctx, p.client, p.endpoint, p.headers(), body)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var sb strings.Builder
+	result := &CompletionResult{}
+	err = readSSE(stream, func(event, data string) error {
+		var ev anthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return fmt.Errorf("解析流式响应失败: %v, 响应内容: %s", err, data)
+		}
+		switch ev.Type {
+		case "message_start":
+			result.Usage.PromptTokens = ev.Message.Usage.InputTokens
+		case "content_block_delta":
+			if ev.Delta.Type == "text_delta" && ev.Delta.Text != "" {
+				sb.WriteString(ev.Delta.Text)
+				return onDelta(ev.Delta.Text)
+			}
+		case "message_delta":
+			result.FinishReason = ev.Delta.StopReason
+			result.Usage.CompletionTokens = ev.Usage.OutputTokens
+		case "error":
+			return fmt.Errorf("流式响应错误: %s: %s", ev.Error.Type, ev.Error.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Content = sb.String()
+	result.Usage.TotalTokens = result.Usage.PromptTokens + result.Usage.CompletionTokens
+	return result, nil
+}
+
+// buildRequest Anthropic不接受system角色的消息，需单独放到system字段；
+// temperature上限为1，超出时取1，不支持presence/frequency penalty
+func (p *anthropicProvider) buildRequest(req CompletionRequest) anthropicRequest {
+	var system []string
+	msgs := make([]ChatMessage, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		if m.Role == "system" {
+			system = append(system, m.Content)
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	out := anthropicRequest{
+		Model:         req.Model,
+		System:        strings.Join(system, "\n"),
+		Messages:      msgs,
+		MaxTokens:     anthropicMaxTokens,
+		TopP:          req.Params.TopP,
+		StopSequences: req.Params.Stop,
+	}
+	if req.Params.MaxTokens != nil {
+		out.MaxTokens = *req.Params.MaxTokens
+	}
+	if t := req.Params.Temperature; t != nil {
+		out.Temperature = t
+		if *t > 1 {
+			one := 1.0
+			out.Temperature = &one
+		}
+	}
+	return out
+}
+
+func (p *anthropicProvider) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         p.apiKey,
+		"anthropic-version": anthropicVersion,
+	}
+}
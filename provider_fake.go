@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"unicode/utf8"
+)
+
+// fakeStreamChunk 流式模式下每段推送的字符数
+const fakeStreamChunk = 4
+
+// fakeProvider 进程内假后端，不访问网络，用于本地调试和测试handleChat
+type fakeProvider struct {
+	mu sync.Mutex
+	// Reply 自定义回复，为空时回显最后一条消息
+	Reply func(req CompletionRequest) (string, error)
+	// Record 为true时在Calls中记录收到的全部请求，供测试检查；作为常驻服务的后端时不记录，避免无限增长
+	Record bool
+	Calls  []CompletionRequest
+}
+
+func (p *fakeProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	if p.Record {
+		p.Calls = append(p.Calls, req)
+	}
+	reply := p.Reply
+	p.mu.Unlock()
+
+	var content string
+	if reply != nil {
+		var err error
+		if content, err = reply(req); err != nil {
+			return nil, err
+		}
+	} else if n := len(req.Messages); n > 0 {
+		content = "[fake] " + req.Messages[n-1].Content
+	}
+
+	prompt := 0
+	for _, m := range req.Messages {
+		prompt += utf8.RuneCountInString(m.Content)
+	}
+	completion := utf8.RuneCountInString(content)
+	return &CompletionResult{
+		Content:      content,
+		FinishReason: "stop",
+		Usage: Usage{
+			PromptTokens:     prompt,
+			CompletionTokens: completion,
+			TotalTokens:      prompt + completion,
+		},
+	}, nil
+}
+
+// Stream 把完整回复按字符逐段推送，模拟流式输出
+func (p *fakeProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResult, error) {
+	res, err := p.Complete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	runes := []rune(res.Content)
+	for i := 0; i < len(runes); i += fakeStreamChunk {
+		end := i + fakeStreamChunk
+		if end > len(runes) {
+			end = len(runes)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := onDelta(string(runes[i:end])); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
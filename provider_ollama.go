@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ollamaProvider Ollama本地模型，endpoint为 /api/chat 完整地址
+type ollamaProvider struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+}
+
+type ollamaChatRequest struct {
+	Model    string         `json:"model"`
+	Messages []ChatMessage  `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Options  *ollamaOptions `json:"options,omitempty"`
+}
+
+// ollamaOptions 生成参数在Ollama中放在options里，max_tokens对应num_predict
+type ollamaOptions struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	NumPredict       *int     `json:"num_predict,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+}
+
+func newOllamaOptions(p GenerationParams) *ollamaOptions {
+	if p.Temperature == nil && p.TopP == nil && p.MaxTokens == nil && p.PresencePenalty == nil && p.FrequencyPenalty == nil && len(p.Stop) == 0 {
+		return nil
+	}
+	return &ollamaOptions{
+		Temperature:      p.Temperature,
+		TopP:             p.TopP,
+		NumPredict:       p.MaxTokens,
+		PresencePenalty:  p.PresencePenalty,
+		FrequencyPenalty: p.FrequencyPenalty,
+		Stop:             p.Stop,
+	}
+}
+
+type ollamaChatResponse struct {
+	Message         ChatMessage `json:"message"`
+	Done            bool        `json:"done"`
+	DoneReason      string      `json:"done_reason"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+	EvalCount       int         `json:"eval_count"`
+}
+
+func (p *ollamaProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	body := ollamaChatRequest{
+		Model:    req.Model,
+		Messages: req.Messages,
+		Options:  newOllamaOptions(req.Params),
+	}
+	var resp ollamaChatResponse
+	if err := postJSON(ctx, p.client, p.endpoint, p.headers(), body, &resp); err != nil {
+		return nil, err
+	}
+	return &CompletionResult{
+		Content:      resp.Message.Content,
+		FinishReason: resp.DoneReason,
+		Usage:        resp.usage(),
+	}, nil
+}
+
+// Stream Ollama的流式响应是逐行JSON而不是SSE
+func (p *ollamaProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResult, error) {
+	body := ollamaChatRequest{
+		Model:    req.Model,
+		Messages: req.Messages,
+		Stream:   true,
+		Options:  newOllamaOptions(req.Params),
+	}
+	stream, err := postStream(ctx, p.client, p.endpoint, p.headers(), body)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var sb strings.Builder
+	result := &CompletionResult{}
+	dec := json.NewDecoder(stream)
+	for {
+		var chunk ollamaChatResponse
+		if err := dec.Decode(&chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("解析流式响应失败: %v", err)
+		}
+		if chunk.Message.Content != "" {
+			sb.WriteString(chunk.Message.Content)
+			if err := onDelta(chunk.Message.Content); err != nil {
+				return nil, err
+			}
+		}
+		if chunk.Done {
+			result.FinishReason = chunk.DoneReason
+			result.Usage = chunk.usage()
+			break
+		}
+	}
+	result.Content = sb.String()
+	return result, nil
+}
+
+func (r ollamaChatResponse) usage() Usage {
+	return Usage{
+		PromptTokens:     r.PromptEvalCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	}
+}
+
+// headers 本地Ollama一般不需要鉴权，经反向代理时可配置key
+func (p *ollamaProvider) headers() map[string]string {
+	if p.apiKey == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": "Bearer " + p.apiKey}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// openAIProvider OpenAI兼容接口（DeepSeek等），endpoint为 /chat/completions 完整地址
+type openAIProvider struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+}
+
+type openAIChatRequest struct {
+	Model         string               `json:"model"`
+	Messages      []ChatMessage        `json:"messages"`
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+	GenerationParams
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIChatResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int    `json:"created"`
+	Choices []struct {
+		Index        int         `json:"index"`
+		Message      ChatMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
+	} `json:"choices"`
+	Usage Usage `json:"usage"`
+}
+
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+}
+
+func (p *openAIProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	body := openAIChatRequest{
+		Model:            req.Model,
+		Messages:         req.Messages,
+		GenerationParams: req.Params,
+	}
+	var resp openAIChatResponse
+	if err := postJSON(ctx, p.client, p.endpoint, p.headers(), body, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("API返回结果为空")
+	}
+	return &CompletionResult{
+		Content:      resp.Choices[0].Message.Content,
+		FinishReason: resp.Choices[0].FinishReason,
+		Usage:        resp.Usage,
+	}, nil
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResult, error) {
+	body := openAIChatRequest{
+		Model:         req.Model,
+		Messages:      req.Messages,
+		Stream:        true,
+		StreamOptions: &openAIStreamOptions{IncludeUsage: true},
+
+		GenerationParams: req.Params,
+	}
+	stream, err := postStream(ctx, p.client, p.endpoint, p.headers(), body)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var sb strings.Builder
+	result := &CompletionResult{}
+	err = readSSE(stream, func(event, data string) error {
+		if data == "[DONE]" {
+			return nil
+		}
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("解析流式响应失败: %v, 响应内容: %s", err, data)
+		}
+		if chunk.Usage != nil {
+			result.Usage = *chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+		if chunk.Choices[0].FinishReason != "" {
+			result.FinishReason = chunk.Choices[0].FinishReason
+		}
+		if delta := chunk.Choices[0].Delta.Content; delta != "" {
+			sb.WriteString(delta)
+			return onDelta(delta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Content = sb.String()
+	return result, nil
+}
+
+func (p *openAIProvider) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + p.apiKey}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errCircuitOpen 熔断期间直接返回，不再请求上游
+var errCircuitOpen = errors.New("模型服务熔断中")
+
+// errAttemptTimeout 单次尝试超过attempt_timeout，调用方的总超时还没到
+var errAttemptTimeout = errors.New("模型单次请求超时")
+
+// resilientProvider 给任意模型后端加上重试和熔断，main中创建后端后统一包装
+type resilientProvider struct {
+	next    LLMProvider
+	retry   RetryConfig
+	breaker *circuitBreaker
+}
+
+func newResilientProvider(next LLMProvider, retry RetryConfig, cb CircuitBreakerConfig) *resilientProvider {
+	return &resilientProvider{
+		next:    next,
+		retry:   retry,
+		breaker: &circuitBreaker{threshold: cb.FailureThreshold, cooldown: cb.Cooldown.Duration},
+	}
+}
+
+func (p *resilientProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	var res *CompletionResult
+	err := p.do(ctx, func(ctx context.Context, _ func()) (bool, error) {
+		var err error
+		res, err = p.next.Complete(ctx, req)
+		return true, err
+	})
+	return res, err
+}
+
+// Stream 已经向客户端推送过内容后再重试会导致重复输出，因此只在收到第一段内容之前失败时重试
+func (p *resilientProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResult, error) {
+	var res *CompletionResult
+	err := p.do(ctx, func(ctx context.Context, firstByte func()) (bool, error) {
+		started := false
+		var err error
+		res, err = p.next.Stream(ctx, req, func(delta string) error {
+			if !started {
+				started = true
+				firstByte()
+			}
+			return onDelta(delta)
+		})
+		return !started, err
+	})
+	return res, err
+}
+
+// do 执行call直到成功、遇到不可重试的错误或用完尝试次数；call返回本次失败后是否还能安全重试
+func (p *resilientProvider) do(ctx context.Context, call func(ctx context.Context, stopTimer func()) (bool, error)) error {
+	for attempt := 1; ; attempt++ {
+		if !p.breaker.allow() {
+			return errCircuitOpen
+		}
+		canRetry, err := p.attempt(ctx, call)
+		if err == nil {
+			p.breaker.success()
+			return nil
+		}
+		retryable, upstreamDown := classifyError(ctx, err)
+		if upstreamDown {
+			p.breaker.failure()
+		} else {
+			// 429只说明需要等待，既不算恢复也不算故障；半开时结束本次试探，由下一个请求继续试探
+			p.breaker.release()
+		}
+		if !retryable || !canRetry || attempt >= p.retry.MaxAttempts {
+			return err
+		}
+		delay := p.backoff(attempt, err)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		log.Printf("模型调用失败，%s后进行第%d次尝试: %v", formatDuration(delay), attempt+1, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt 执行一次call，超过attempt_timeout时取消本次请求并返回errAttemptTimeout；
+// call收到第一段流式内容后调用stopTimer，之后只受调用方的总超时限制
+func (p *resilientProvider) attempt(ctx context.Context, call func(ctx context.Context, stopTimer func()) (bool, error)) (bool, error) {
+	actx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var timedOut atomic.Bool
+	stopTimer := func() {}
+	if d := p.retry.AttemptTimeout.Duration; d > 0 {
+		timer := time.AfterFunc(d, func() {
+			timedOut.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+		stopTimer = func() { timer.Stop() }
+	}
+	canRetry, err := call(actx, stopTimer)
+	if err != nil && timedOut.Load() && ctx.Err() == nil {
+		err = fmt.Errorf("%w（%s）: %v", errAttemptTimeout, formatDuration(p.retry.AttemptTimeout.Duration), err)
+	}
+	return canRetry, err
+}
+
+// backoff 上游给出Retry-After时照办，否则在指数退避上限的后一半内随机取值（equal jitter），保证两次尝试之间至少间隔一半
+func (p *resilientProvider) backoff(attempt int, err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+	d := p.retry.BaseDelay.Duration << (attempt - 1)
+	if d <= 0 || d > p.retry.MaxDelay.Duration {
+		d = p.retry.MaxDelay.Duration
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// classifyError 判断错误能否重试，以及是否说明上游不可用（计入熔断）
+func classifyError(ctx context.Context, err error) (retryable, upstreamDown bool) {
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		// 客户端已断开
+		return false, false
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		// 总超时已用完，不再重试，但说明上游响应过慢
+		return false, true
+	case errors.Is(err, errAttemptTimeout):
+		// 本次尝试超时而总超时还有余量
+		return true, true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			return true, false
+		case apiErr.StatusCode >= 500 && apiErr.StatusCode != http.StatusNotImplemented:
+			return true, true
+		}
+		return false, false
+	}
+	if transientNetError(err) {
+		return true, true
+	}
+	return false, false
+}
+
+// transientNetError 超时、连接被拒绝或中断等暂时性的网络错误；
+// 证书校验失败、地址格式错误、域名不存在等重试也不会成功的错误不在其中
+func transientNetError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, target := range []error{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED,
+		syscall.EPIPE, syscall.EHOSTUNREACH, syscall.ENETUNREACH, io.ErrUnexpectedEOF, io.EOF} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// circuitBreaker 关闭时正常放行；连续失败达到阈值后打开，冷却期内全部拒绝；
+// 冷却结束后半开，只放行一个试探请求，成功则关闭，失败则重新计时
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold > 0 && b.failures >= b.threshold {
+		log.Printf("模型服务已恢复，解除熔断")
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Printf("模型服务连续失败%d次，熔断%s", b.failures, formatDuration(b.cooldown))
+	}
+}
+
+// release 与上游是否可用无关的失败（如客户端断开），只结束试探，不改变计数
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// upstreamError 模型调用失败时可以直接返回给用户的状态码和提示，详细错误只写日志，不把上游响应体透传给前端
+type upstreamError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *upstreamError) Error() string {
+	return e.Message
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.Err
+}
+
+func newUpstreamError(err error) *upstreamError {
+	ue := &upstreamError{Status: http.StatusBadGateway, Message: "模型调用失败，请稍后重试", Err: err}
+	var apiErr *APIError
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		ue.Status, ue.Message = http.StatusServiceUnavailable, "模型服务暂时不可用，请稍后再试"
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errAttemptTimeout):
+		ue.Status, ue.Message = http.StatusGatewayTimeout, "模型响应超时，请稍后重试"
+	case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests:
+		ue.Status, ue.Message = http.StatusServiceUnavailable, "模型服务繁忙，请稍后再试"
+	case errors.As(err, &apiErr):
+		ue.Message = fmt.Sprintf("模型服务返回错误（状态码%d），请稍后重试", apiErr.StatusCode)
+	}
+	return ue
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// hangingProvider 前hang次调用一直挂起到ctx结束，之后正常返回
+type hangingProvider struct {
+	hang  int
+	calls int
+}
+
+func (p *hangingProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	p.calls++
+	if p.calls <= p.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &CompletionResult{Content: "ok"}, nil
+}
+
+func (p *hangingProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResult, error) {
+	res, err := p.Complete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return res, onDelta(res.Content)
+}
+
+func testRetry(attemptTimeout time.Duration) RetryConfig {
+	return RetryConfig{
+		MaxAttempts:    3,
+		BaseDelay:      Duration{time.Millisecond},
+		MaxDelay:       Duration{time.Millisecond},
+		AttemptTimeout: Duration{attemptTimeout},
+	}
+}
+
+// TestAttemptTimeoutRetried 单次尝试超时后在总超时内重试
+func TestAttemptTimeoutRetried(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		next := &hangingProvider{hang: 1}
+		p := newResilientProvider(next, testRetry(50*time.Millisecond), CircuitBreakerConfig{})
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		var err error
+		if stream {
+			_, err = p.Stream(ctx, CompletionRequest{}, func(string) error { return nil })
+		} else {
+			_, err = p.Complete(ctx, CompletionRequest{})
+		}
+		cancel()
+		if err != nil || next.calls != 2 {
+			t.Errorf("stream=%v: err=%v calls=%d，期望第2次成功", stream, err, next.calls)
+		}
+	}
+}
+
+// TestAttemptTimeoutExhausted 每次都超时时用完尝试次数，返回超时错误
+func TestAttemptTimeoutExhausted(t *testing.T) {
+	next := &hangingProvider{hang: 10}
+	p := newResilientProvider(next, testRetry(20*time.Millisecond), CircuitBreakerConfig{})
+	_, err := p.Complete(context.Background(), CompletionRequest{})
+	if !errors.Is(err, errAttemptTimeout) || next.calls != 3 {
+		t.Fatalf("err=%v calls=%d", err, next.calls)
+	}
+	if ue := newUpstreamError(err); ue.Status != 504 {
+		t.Errorf("状态码%d，期望504", ue.Status)
+	}
+}
+
+// TestParentDeadlineNotRetried 总超时用完时不再重试
+func TestParentDeadlineNotRetried(t *testing.T) {
+	next := &hangingProvider{hang: 10}
+	p := newResilientProvider(next, testRetry(time.Second), CircuitBreakerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err := p.Complete(ctx, CompletionRequest{})
+	if !errors.Is(err, context.DeadlineExceeded) || next.calls != 1 {
+		t.Errorf("err=%v calls=%d，期望只尝试1次", err, next.calls)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 全文检索：MySQL 使用 ngram 分词的 FULLTEXT 索引（支持中文），SQLite 使用 trigram 分词的 FTS5 外部内容表，
+// 由触发器与 messages 表保持同步。检索词短于分词粒度时两者都无法命中，退回 LIKE 匹配并按命中次数排序
+
+const (
+	mysqlMessageFullText = "ft_messages_content"
+	mysqlSessionFullText = "ft_sessions_name"
+	snippetRadius        = 40
+	maxSearchTerms       = 8
+)
+
+// SearchMessageHit 命中的消息，Snippet 为已转义的HTML，命中词用<mark>包裹
+type SearchMessageHit struct {
+	MessageID   uint      `json:"messageId"`
+	SessionID   string    `json:"sessionId"`
+	SessionName string    `json:"sessionName"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Snippet     string    `json:"snippet"`
+	Score       float64   `json:"score"`
+}
+
+// SearchSessionHit 名称命中的会话
+type SearchSessionHit struct {
+	SessionID  string    `json:"sessionId"`
+	Name       string    `json:"name"`
+	Highlight  string    `json:"highlight"`
+	AIName     string    `json:"aiName"`
+	Terminated bool      `json:"terminated"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Score      float64   `json:"score"`
+}
+
+type searchFilter struct {
+	UserID     uint
+	PersonaID  *uint
+	From, To   *time.Time
+	Role       string
+	Terminated *bool
+}
+
+// setupFullText 建立全文索引，已存在时跳过
+func setupFullText(db *gorm.DB) error {
+	switch db.Dialector.Name() {
+	case "mysql":
+		indexes := map[string]string{
+			mysqlMessageFullText: "ALTER TABLE messages ADD FULLTEXT INDEX " + mysqlMessageFullText + " (content) WITH PARSER ngram",
+			mysqlSessionFullText: "ALTER TABLE sessions ADD FULLTEXT INDEX " + mysqlSessionFullText + " (name) WITH PARSER ngram",
+		}
+		for name, ddl := range indexes {
+			var n int64
+			if err := db.Raw("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND index_name = ?", name).Scan(&n).Error; err != nil {
+				return err
+			}
+			if n == 0 {
+				if err := db.Exec(ddl).Error; err != nil {
+					return err
+				}
+			}
+		}
+	case "sqlite":
+		var n int64
+		if err := db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages_fts'").Scan(&n).Error; err != nil {
+			return err
+		}
+		stmts := []string{
+			"CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content, content='messages', content_rowid='id', tokenize='trigram')",
+			"CREATE TRIGGER IF NOT EXISTS messages_fts_ai AFTER INSERT ON messages BEGIN INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content); END",
+			"CREATE TRIGGER IF NOT EXISTS messages_fts_ad AFTER DELETE ON messages BEGIN INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content); END",
+			"CREATE TRIGGER IF NOT EXISTS messages_fts_au AFTER UPDATE OF content ON messages BEGIN INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content); INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content); END",
+		}
+		// 新建索引时把已有消息导入
+		if n == 0 {
+			stmts = append(stmts, "INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')")
+		}
+		for _, stmt := range stmts {
+			if err := db.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// searchTerms 按空白拆分检索词，去重并限制数量
+func searchTerms(q string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, t := range strings.Fields(q) {
+		key := strings.ToLower(t)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		terms = append(terms, t)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// useFullText 全部检索词都达到分词粒度时才能走索引：ngram默认2个字符，trigram为3个字符
+func useFullText(terms []string) bool {
+	minRunes := 2
+	if db.Dialector.Name() == "sqlite" {
+		minRunes = 3
+	}
+	for _, t := range terms {
+		if utf8.RuneCountInString(t) < minRunes {
+			return false
+		}
+	}
+	return true
+}
+
+func likePattern(term string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(term) + "%"
+}
+
+// likeCond 按likePattern的转义方式匹配；MySQL默认的sql_mode下反斜杠在字符串字面量里也是转义符，要写成'\\'
+func likeCond(dialect, column string) string {
+	if dialect == "mysql" {
+		return column + ` LIKE ? ESCAPE '\\'`
+	}
+	return column + ` LIKE ? ESCAPE '\'`
+}
+
+// likeHits LIKE没有相关度，用各检索词（不区分大小写）出现的次数之和排序，与highlightSnippet的计数一致
+func likeHits(dialect, column string, terms []string) (string, []interface{}) {
+	length := "LENGTH"
+	if dialect == "mysql" {
+		length = "CHAR_LENGTH"
+	}
+	parts := make([]string, len(terms))
+	var args []interface{}
+	for i, t := range terms {
+		parts[i] = fmt.Sprintf("(%[1]s(LOWER(%[2]s)) - %[1]s(REPLACE(LOWER(%[2]s), LOWER(?), ''))) / %[1]s(?)", length, column)
+		args = append(args, t, t)
+	}
+	return strings.Join(parts, " + "), args
+}
+
+// ftsQuery 每个词作为FTS5短语，多个词之间为AND
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// mysqlBooleanQuery 每个词都必须出现，词内部按短语匹配
+func mysqlBooleanQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `+"` + strings.ReplaceAll(t, `"`, ` `) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+func applySessionFilter(q *gorm.DB, f searchFilter) *gorm.DB {
+	q = q.Where("sessions.user_id = ?", f.UserID)
+	if f.PersonaID != nil {
+		q = q.Where("sessions.persona_id = ?", *f.PersonaID)
+	}
+	if f.Terminated != nil {
+		q = q.Where("sessions.terminated = ?", *f.Terminated)
+	}
+	return q
+}
+
+func searchMessages(terms []string, f searchFilter, limit, offset int) ([]SearchMessageHit, int64, error) {
+	type row struct {
+		ID          uint
+		SessionID   string
+		SessionName string
+		Role        string
+		Content     string
+		CreatedAt   time.Time
+		Score       float64
+	}
+	fullText := useFullText(terms)
+	q := applySessionFilter(db.Table("messages").Joins("JOIN sessions ON sessions.id = messages.session_id"), f)
+	score := "0"
+	var scoreArgs []interface{}
+	switch {
+	case fullText && db.Dialector.Name() == "mysql":
+		bq := mysqlBooleanQuery(terms)
+		q = q.Where("MATCH(messages.content) AGAINST(? IN BOOLEAN MODE)", bq)
+		score, scoreArgs = "MATCH(messages.content) AGAINST(? IN BOOLEAN MODE)", []interface{}{bq}
+	case fullText && db.Dialector.Name() == "sqlite":
+		q = q.Joins("JOIN messages_fts ON messages_fts.rowid = messages.id").Where("messages_fts MATCH ?", ftsQuery(terms))
+		score = "-bm25(messages_fts)"
+	default:
+		for _, t := range terms {
+			q = q.Where(likeCond(db.Dialector.Name(), "messages.content"), likePattern(t))
+		}
+		score, scoreArgs = likeHits(db.Dialector.Name(), "messages.content", terms)
+	}
+	if f.Role != "" {
+		q = q.Where("messages.role = ?", f.Role)
+	} else {
+		q = q.Where("messages.role <> ?", "system")
+	}
+	if f.From != nil {
+		q = q.Where("messages.created_at >= ?", *f.From)
+	}
+	if f.To != nil {
+		q = q.Where("messages.created_at < ?", *f.To)
+	}
+
+	var total int64
+	if err := q.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var rows []row
+	sel := "messages.id, messages.session_id, sessions.name AS session_name, messages.role, messages.content, messages.created_at, " + score + " AS score"
+	err := q.Select(sel, scoreArgs...).Order("score desc").Order("messages.created_at desc").Limit(limit).Offset(offset).Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hits := make([]SearchMessageHit, 0, len(rows))
+	for _, r := range rows {
+		snippet, _ := highlightSnippet(r.Content, terms, snippetRadius)
+		hits = append(hits, SearchMessageHit{
+			MessageID:   r.ID,
+			SessionID:   r.SessionID,
+			SessionName: r.SessionName,
+			Role:        r.Role,
+			CreatedAt:   r.CreatedAt,
+			Snippet:     snippet,
+			Score:       r.Score,
+		})
+	}
+	return hits, total, nil
+}
+
+// searchSessions 会话名称较短、数量有限，MySQL 走 FULLTEXT，其余用 LIKE 并按命中次数取前50个
+func searchSessions(terms []string, f searchFilter) ([]SearchSessionHit, error) {
+	q := applySessionFilter(db.Model(&Session{}), f)
+	if useFullText(terms) && db.Dialector.Name() == "mysql" {
+		q = q.Where("MATCH(sessions.name) AGAINST(? IN BOOLEAN MODE)", mysqlBooleanQuery(terms))
+	} else {
+		for _, t := range terms {
+			q = q.Where(likeCond(db.Dialector.Name(), "sessions.name"), likePattern(t))
+		}
+		hits, args := likeHits(db.Dialector.Name(), "sessions.name", terms)
+		q = q.Order(clause.OrderBy{Expression: clause.Expr{SQL: hits + " DESC", Vars: args, WithoutParentheses: true}})
+	}
+	if f.From != nil {
+		q = q.Where("sessions.created_at >= ?", *f.From)
+	}
+	if f.To != nil {
+		q = q.Where("sessions.created_at < ?", *f.To)
+	}
+	var sessions []Session
+	if err := q.Order("sessions.created_at desc").Limit(50).Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	hits := make([]SearchSessionHit, 0, len(sessions))
+	for _, s := range sessions {
+		hl, count := highlightSnippet(s.Name, terms, 64)
+		hits = append(hits, SearchSessionHit{
+			SessionID:  s.ID,
+			Name:       s.Name,
+			Highlight:  hl,
+			AIName:     s.AIName,
+			Terminated: s.Terminated,
+			CreatedAt:  s.CreatedAt,
+			Score:      float64(count),
+		})
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	return hits, nil
+}
+
+// highlightSnippet 截取第一个命中词前后radius个字符，转义HTML后用<mark>标出所有命中词，
+// 同时返回命中次数。大小写不敏感
+func highlightSnippet(content string, terms []string, radius int) (string, int) {
+	text := []rune(content)
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+	marks := make([]bool, len(text))
+	count, first := 0, -1
+	for _, t := range terms {
+		term := []rune(strings.ToLower(t))
+		if len(term) == 0 {
+			continue
+		}
+		for i := 0; i+len(term) <= len(lower); i++ {
+			if string(lower[i:i+len(term)]) != string(term) {
+				continue
+			}
+			count++
+			if first < 0 || i < first {
+				first = i
+			}
+			for j := i; j < i+len(term); j++ {
+				marks[j] = true
+			}
+		}
+	}
+
+	start, end := 0, len(text)
+	if first >= 0 {
+		start = first - radius
+		if start < 0 {
+			start = 0
+		}
+		end = first + radius*2
+	} else {
+		end = radius * 2
+	}
+	if end > len(text) {
+		end = len(text)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	open := false
+	for i := start; i < end; i++ {
+		if marks[i] && !open {
+			b.WriteString("<mark>")
+			open = true
+		} else if !marks[i] && open {
+			b.WriteString("</mark>")
+			open = false
+		}
+		b.WriteString(html.EscapeString(string(text[i])))
+	}
+	if open {
+		b.WriteString("</mark>")
+	}
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String(), count
+}
+
+// parseDateRange 解析from/to（YYYY-MM-DD），返回的to为次日零点，即to当天包含在内
+func parseDateRange(q url.Values) (*time.Time, *time.Time, error) {
+	var from, to *time.Time
+	if v := q.Get("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return nil, nil, fmt.Errorf("from格式应为YYYY-MM-DD")
+		}
+		from = &t
+	}
+	if v := q.Get("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return nil, nil, fmt.Errorf("to格式应为YYYY-MM-DD")
+		}
+		t = t.AddDate(0, 0, 1)
+		to = &t
+	}
+	return from, to, nil
+}
+
+// parseSearchFilter 解析筛选参数：personaId、from/to（YYYY-MM-DD，to当天包含在内）、role、terminated
+func parseSearchFilter(r *http.Request) (searchFilter, error) {
+	q := r.URL.Query()
+	f := searchFilter{UserID: currentUserID(r)}
+	if v := q.Get("personaId"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return f, fmt.Errorf("personaId格式错误")
+		}
+		pid := uint(id)
+		f.PersonaID = &pid
+	}
+	var err error
+	if f.From, f.To, err = parseDateRange(q); err != nil {
+		return f, err
+	}
+	switch role := q.Get("role"); role {
+	case "", "user", "assistant", "system":
+		f.Role = role
+	default:
+		return f, fmt.Errorf("role只能是user、assistant或system")
+	}
+	if v := q.Get("terminated"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("terminated应为true或false")
+		}
+		f.Terminated = &b
+	}
+	return f, nil
+}
+
+// handleSearch 在当前用户的会话名称和消息内容中检索，消息结果按相关度排序并分页（limit/offset）
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	terms := searchTerms(r.URL.Query().Get("q"))
+	if len(terms) == 0 {
+		http.Error(w, "缺少检索词q", http.StatusBadRequest)
+		return
+	}
+	f, err := parseSearchFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	msgs, total, err := searchMessages(terms, f, limit, offset)
+	if err != nil {
+		http.Error(w, "检索失败", http.StatusInternalServerError)
+		return
+	}
+	var sessions []SearchSessionHit
+	if offset == 0 {
+		if sessions, err = searchSessions(terms, f); err != nil {
+			http.Error(w, "检索失败", http.StatusInternalServerError)
+			return
+		}
+	}
+	if sessions == nil {
+		sessions = []SearchSessionHit{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"terms":         terms,
+		"sessions":      sessions,
+		"messages":      msgs,
+		"totalMessages": total,
+		"limit":         limit,
+		"offset":        offset,
+	})
+}
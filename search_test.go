@@ -0,0 +1,104 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestDB 在临时目录中建一个迁移好的SQLite库，替换全局的cfg和db
+func openTestDB(t *testing.T) {
+	t.Helper()
+	cfg = defaultConfig()
+	cfg.Database = DatabaseConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "test.db")}
+	var err error
+	if db, err = openDatabase(cfg.Database); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+// createTestSession 为用户建一个会话并依次保存消息
+func createTestSession(t *testing.T, userID uint, id, name string, contents ...string) {
+	t.Helper()
+	if err := db.Create(&Session{ID: id, Name: name, UserID: &userID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range contents {
+		if err := db.Create(&Message{SessionID: id, Role: "user", Content: c}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLikeCond(t *testing.T) {
+	if got := likeCond("mysql", "c"); got != `c LIKE ? ESCAPE '\\'` {
+		t.Errorf("mysql: %s", got)
+	}
+	if got := likeCond("sqlite", "c"); got != `c LIKE ? ESCAPE '\'` {
+		t.Errorf("sqlite: %s", got)
+	}
+}
+
+// TestSearchLikeFallback 单个汉字短于trigram，走LIKE：按命中次数跨页排序，%和_按字面匹配
+func TestSearchLikeFallback(t *testing.T) {
+	openTestDB(t)
+	user := User{Username: "alice"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	createTestSession(t, user.ID, "s1", "猫咪", "一只猫", "猫猫猫", "没有", "100%_完成")
+	createTestSession(t, user.ID, "s2", "猫猫日记", "猫猫")
+	other := User{Username: "bob"}
+	db.Create(&other)
+	createTestSession(t, other.ID, "s3", "猫", "猫猫猫猫")
+
+	terms := searchTerms("猫")
+	if useFullText(terms) {
+		t.Fatal("单字检索不应走全文索引")
+	}
+	f := searchFilter{UserID: user.ID}
+	var got []string
+	for offset := 0; ; offset++ {
+		hits, total, err := searchMessages(terms, f, 1, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 3 {
+			t.Fatalf("total=%d，期望3", total)
+		}
+		if len(hits) == 0 {
+			break
+		}
+		got = append(got, hits[0].Snippet)
+	}
+	want := []string{"<mark>猫猫猫</mark>", "<mark>猫猫</mark>", "一只<mark>猫</mark>"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("排序为%v，期望%v", got, want)
+	}
+
+	for q, n := range map[string]int64{"%": 1, "_": 1, "%_": 1, "%完": 0} {
+		_, total, err := searchMessages(searchTerms(q), f, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != n {
+			t.Errorf("检索%q命中%d条，期望%d", q, total, n)
+		}
+	}
+
+	sessions, err := searchSessions(terms, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].SessionID != "s2" {
+		t.Errorf("会话结果%+v，期望s2在前", sessions)
+	}
+}
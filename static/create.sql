@@ -1,3 +1,22 @@
+CREATE TABLE `users` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `username` VARCHAR(64) NOT NULL,
+  `password_hash` VARCHAR(128) NOT NULL,
+  `created_at` DATETIME,
+  `updated_at` DATETIME,
+  UNIQUE INDEX (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `login_sessions` (
+  `token_hash` VARCHAR(64) NOT NULL PRIMARY KEY,
+  `user_id` INT UNSIGNED NOT NULL,
+  `expires_at` DATETIME,
+  `created_at` DATETIME,
+  FOREIGN KEY (`user_id`) REFERENCES `users`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  INDEX (`user_id`),
+  INDEX (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 CREATE TABLE `personas` (
   `id` INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `name` VARCHAR(64) NOT NULL,
@@ -6,7 +25,40 @@ CREATE TABLE `personas` (
   `appearance` TEXT,
   `personality` TEXT,
   `created_at` DATETIME,
-  `updated_at` DATETIME
+  `updated_at` DATETIME,
+  `user_id` INT UNSIGNED DEFAULT NULL,
+  `gen_temperature` DOUBLE DEFAULT NULL,
+  `gen_top_p` DOUBLE DEFAULT NULL,
+  `gen_max_tokens` BIGINT DEFAULT NULL,
+  `gen_presence_penalty` DOUBLE DEFAULT NULL,
+  `gen_frequency_penalty` DOUBLE DEFAULT NULL,
+  `gen_stop` TEXT,
+  `version` BIGINT DEFAULT 0,
+  `prompt_template` TEXT,
+  FOREIGN KEY (`user_id`) REFERENCES `users`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  INDEX (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+-- 人格的不可变历史版本，会话固定使用其中一个
+CREATE TABLE `persona_revisions` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `persona_id` INT UNSIGNED NOT NULL,
+  `version` BIGINT,
+  `name` VARCHAR(64),
+  `avatar` VARCHAR(256),
+  `identity` VARCHAR(128),
+  `appearance` TEXT,
+  `personality` TEXT,
+  `prompt_template` TEXT,
+  `rolled_back_from` BIGINT DEFAULT NULL,
+  `gen_temperature` DOUBLE DEFAULT NULL,
+  `gen_top_p` DOUBLE DEFAULT NULL,
+  `gen_max_tokens` BIGINT DEFAULT NULL,
+  `gen_presence_penalty` DOUBLE DEFAULT NULL,
+  `gen_frequency_penalty` DOUBLE DEFAULT NULL,
+  `gen_stop` TEXT,
+  `created_at` DATETIME,
+  FOREIGN KEY (`persona_id`) REFERENCES `personas`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  UNIQUE INDEX `idx_persona_version` (`persona_id`, `version`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE `sessions` (
@@ -20,16 +72,102 @@ CREATE TABLE `sessions` (
   `created_at` DATETIME,
   `updated_at` DATETIME,
   `persona_id` INT UNSIGNED DEFAULT NULL,
-  FOREIGN KEY (`persona_id`) REFERENCES `personas`(`id`) ON DELETE SET NULL ON UPDATE CASCADE
+  `user_id` INT UNSIGNED DEFAULT NULL,
+  `head_message_id` INT UNSIGNED DEFAULT NULL,
+  `persona_revision_id` INT UNSIGNED DEFAULT NULL,
+  `pending_exit_id` INT UNSIGNED DEFAULT NULL,
+  `exit_message_id` INT UNSIGNED DEFAULT NULL,
+  `name_before_end` VARCHAR(64),
+  `gen_temperature` DOUBLE DEFAULT NULL,
+  `gen_top_p` DOUBLE DEFAULT NULL,
+  `gen_max_tokens` BIGINT DEFAULT NULL,
+  `gen_presence_penalty` DOUBLE DEFAULT NULL,
+  `gen_frequency_penalty` DOUBLE DEFAULT NULL,
+  `gen_stop` TEXT,
+  `turn_mode` VARCHAR(16),
+  FOREIGN KEY (`persona_id`) REFERENCES `personas`(`id`) ON DELETE SET NULL ON UPDATE CASCADE,
+  FOREIGN KEY (`user_id`) REFERENCES `users`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  INDEX (`user_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE `messages` (
   `id` INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `session_id` VARCHAR(64) NOT NULL,
+  `parent_id` INT UNSIGNED DEFAULT NULL,
   `role` VARCHAR(16),
   `content` TEXT,
   `meta` VARCHAR(128),
   `created_at` DATETIME,
+  `persona_id` INT UNSIGNED DEFAULT NULL,
+  `speaker` VARCHAR(64),
+  `speaker_avatar` VARCHAR(256),
+  FOREIGN KEY (`session_id`) REFERENCES `sessions`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  INDEX (`session_id`),
+  INDEX (`parent_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+-- 滚动摘要，覆盖up_to_message_id及之前的消息；删除会话时一并删除
+CREATE TABLE `session_summaries` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `session_id` VARCHAR(64),
+  `content` TEXT,
+  `up_to_message_id` INT UNSIGNED,
+  `message_count` BIGINT,
+  `created_at` DATETIME,
   FOREIGN KEY (`session_id`) REFERENCES `sessions`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
   INDEX (`session_id`)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
\ No newline at end of file
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+-- 群聊成员，position为轮流发言的顺序；删除会话或人格时一并删除
+CREATE TABLE `session_members` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `session_id` VARCHAR(64) NOT NULL,
+  `persona_id` INT UNSIGNED NOT NULL,
+  `position` BIGINT,
+  `revision_id` INT UNSIGNED DEFAULT NULL,
+  FOREIGN KEY (`session_id`) REFERENCES `sessions`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  FOREIGN KEY (`persona_id`) REFERENCES `personas`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  INDEX (`session_id`),
+  INDEX (`persona_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+-- 每次模型调用的用量，会话和人格删除后仍保留
+CREATE TABLE `usage_records` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` INT UNSIGNED DEFAULT NULL,
+  `session_id` VARCHAR(64),
+  `persona_id` INT UNSIGNED DEFAULT NULL,
+  `message_id` INT UNSIGNED DEFAULT NULL,
+  `kind` VARCHAR(16),
+  `model` VARCHAR(64),
+  `prompt_tokens` BIGINT DEFAULT 0,
+  `completion_tokens` BIGINT DEFAULT 0,
+  `total_tokens` BIGINT DEFAULT 0,
+  `latency_ms` BIGINT DEFAULT 0,
+  `cost` DOUBLE DEFAULT 0,
+  `created_at` DATETIME,
+  FOREIGN KEY (`user_id`) REFERENCES `users`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  INDEX (`user_id`),
+  INDEX (`session_id`),
+  INDEX (`persona_id`),
+  INDEX (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `jobs` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `kind` VARCHAR(32),
+  `user_id` INT UNSIGNED DEFAULT NULL,
+  `session_id` VARCHAR(64),
+  `payload` TEXT,
+  `status` VARCHAR(16),
+  `run_at` DATETIME,
+  `attempts` BIGINT DEFAULT 0,
+  `max_attempts` BIGINT DEFAULT 0,
+  `locked_until` DATETIME DEFAULT NULL,
+  `last_error` TEXT,
+  `created_at` DATETIME,
+  `updated_at` DATETIME,
+  `finished_at` DATETIME DEFAULT NULL,
+  FOREIGN KEY (`user_id`) REFERENCES `users`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  FOREIGN KEY (`session_id`) REFERENCES `sessions`(`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  INDEX (`user_id`),
+  INDEX (`session_id`),
+  INDEX `idx_job_status_run` (`status`, `run_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -1,20 +1,138 @@
 let currentSessionId = null;
 let sessions = [];
 let isLoading = false;
-let renamePollingTimer = null;
+let sessionsHasMore = false;
+let loadedMessages = [];
+let messagesHasMore = false;
 let aiName = "AI助手";
 let aiAvatar = "/static/ai_avatar.png";
+let models = [];
 
 // 人格相关
 let personas = [];
 let personaAvatarTemp = "/static/ai_avatar.png";
 
+// 登录失效时所有接口返回401，统一跳转登录页
+const rawFetch = window.fetch.bind(window);
+window.fetch = async (...args) => {
+    const res = await rawFetch(...args);
+    if (res.status === 401) {
+        location.href = '/login';
+        throw new Error('未登录');
+    }
+    return res;
+};
+
 // 初始化
 document.addEventListener('DOMContentLoaded', () => {
-    loadSessions();
+    loadCurrentUser();
+    // 新建会话需要知道默认模型，先加载模型列表
+    loadModels().then(loadSessions).then(connectEvents);
     bindUI();
 });
 
+// 订阅服务端推送的会话和人格变化，后台生成的标题、其他页面的修改都会即时反映到列表
+function connectEvents() {
+    const es = new EventSource('/api/events');
+    let opened = false;
+    // 断线重连期间可能错过事件，重新连上后整体刷新一次
+    es.onopen = () => {
+        if (opened) loadSessions();
+        opened = true;
+    };
+    ['session.created', 'session.renamed', 'session.terminated', 'session.reopened', 'session.deleted', 'session.updated'].forEach(type => {
+        es.addEventListener(type, e => onSessionEvent(type, JSON.parse(e.data)));
+    });
+    ['persona.changed', 'persona.deleted'].forEach(type => {
+        es.addEventListener(type, () => loadPersonas());
+    });
+}
+
+async function onSessionEvent(type, ev) {
+    const isCurrent = ev.sessionId === currentSessionId;
+    if (type === 'session.renamed') {
+        let sess = sessions.find(s => s.id === ev.sessionId);
+        if (sess) sess.name = ev.name;
+        renderSessionList();
+        if (isCurrent) document.getElementById('currentSessionName').textContent = ev.name;
+    } else if (type === 'session.deleted') {
+        sessions = sessions.filter(s => s.id !== ev.sessionId);
+        renderSessionList();
+        if (isCurrent) {
+            if (sessions.length > 0) {
+                switchSession(sessions[0].id);
+            } else {
+                currentSessionId = null;
+                document.getElementById('chatMessages').innerHTML = '';
+                document.getElementById('currentSessionName').textContent = '';
+            }
+        }
+    } else {
+        await loadSessions();
+        // 其他页面结束、重新打开或修改了当前会话
+        if (isCurrent && type !== 'session.created' && !isLoading) {
+            if (type === 'session.updated') switchSession(currentSessionId);
+            else await renderMessages();
+        }
+    }
+}
+
+async function loadCurrentUser() {
+    let res = await fetch('/api/auth/me');
+    let user = await res.json();
+    document.getElementById('currentUsername').innerText = user.username;
+}
+
+// 可用模型列表，默认模型排在第一位
+async function loadModels() {
+    let res = await fetch('/api/models');
+    models = res.ok ? await res.json() : [];
+    const select = document.getElementById('modelSelect');
+    select.innerHTML = '';
+    models.forEach(m => {
+        const opt = document.createElement('option');
+        opt.value = m.name;
+        opt.textContent = m.name;
+        opt.title = `${m.provider} · 上下文${m.contextWindow} · ${(m.capabilities || []).join('、')}`;
+        select.appendChild(opt);
+    });
+}
+
+// 会话记录的模型已不在列表中时，后端按默认模型处理
+function showSessionModel(sess) {
+    const select = document.getElementById('modelSelect');
+    const name = sess && models.find(m => m.name.toLowerCase() === (sess.model || '').toLowerCase());
+    select.value = name ? name.name : (models[0] ? models[0].name : '');
+}
+
+// 对话中途切换当前会话的模型
+async function switchModel(name) {
+    if (!currentSessionId) return;
+    let res = await fetch('/api/session/model', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ sessionId: currentSessionId, model: name })
+    });
+    let sess = sessions.find(s => s.id === currentSessionId);
+    if (!res.ok) {
+        showSessionModel(sess);
+        return showError('切换模型失败: ' + (await res.text()));
+    }
+    if (sess) sess.model = name;
+}
+
+// 导出当前会话，由浏览器直接下载
+function exportCurrentSession() {
+    if (!currentSessionId) return;
+    const format = document.getElementById('exportFormat').value;
+    location.href = `/api/export?format=${format}&sessionId=${encodeURIComponent(currentSessionId)}`;
+}
+
+async function logout() {
+    await fetch('/api/auth/logout', { method: 'POST' });
+    location.href = '/login';
+}
+
 function bindUI() {
     document.getElementById('sendBtn').onclick = sendMessage;
     document.getElementById('messageInput').onkeypress = (e) => {
@@ -23,7 +141,16 @@ function bindUI() {
         }
     };
     document.getElementById('newSessionBtn').onclick = newSession;
+    document.getElementById('modelSelect').onchange = (e) => switchModel(e.target.value);
+    document.getElementById('searchInput').onkeydown = (e) => {
+        if (e.key === 'Enter') searchAll(e.target.value.trim());
+    };
+    document.getElementById('searchInput').oninput = (e) => {
+        if (!e.target.value.trim()) renderSessionList();
+    };
     document.getElementById('terminateBtn').onclick = terminateSession;
+    document.getElementById('logoutBtn').onclick = logout;
+    document.getElementById('exportBtn').onclick = exportCurrentSession;
     document.getElementById('openSettingsBtn').onclick = () => {
         loadPersonas();
         document.getElementById('settingsPanel').classList.remove('hidden');
@@ -38,8 +165,15 @@ function bindUI() {
 
     // 人格卡片相关
     document.getElementById('addPersonaBtn').onclick = showAddPersonaModal;
+    document.getElementById('createGroupBtn').onclick = createGroupChat;
+    document.getElementById('upgradePersonaBtn').onclick = upgradeSessionPersona;
+    document.getElementById('importPersonaBtn').onclick = () => document.getElementById('importPersonaInput').click();
+    document.getElementById('importPersonaInput').onchange = importPersonaCard;
+    document.getElementById('exportPersonaJsonBtn').onclick = () => exportPersonaCard('json');
+    document.getElementById('exportPersonaPngBtn').onclick = () => exportPersonaCard('png');
     document.getElementById('closePersonaModalBtn').onclick = closePersonaModal;
     document.getElementById('savePersonaBtn').onclick = savePersona;
+    document.getElementById('previewPromptBtn').onclick = previewPersonaPrompt;
     document.getElementById('personaAvatarInput').onchange = async function () {
         const fileInput = this;
         if (fileInput.files && fileInput.files[0]) {
@@ -55,10 +189,13 @@ function bindUI() {
     };
 }
 
-// 加载会话列表
+// 加载会话列表（分页，刷新时保留已经加载的条数）
 async function loadSessions() {
-    let res = await fetch('/api/sessions');
-    sessions = await res.json();
+    const limit = Math.min(200, Math.max(50, sessions.length));
+    let res = await fetch('/api/sessions?limit=' + limit);
+    let page = await res.json();
+    sessions = page.items;
+    sessionsHasMore = page.hasMore;
     renderSessionList();
     if (sessions.length > 0) {
         if (!currentSessionId || !sessions.find(s => s.id === currentSessionId)) {
@@ -74,7 +211,7 @@ async function newSession() {
     let res = await fetch('/api/setup', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ modelName: "Deepseek", personality: "", aiName: "AI助手", aiAvatar: "/static/ai_avatar.png" })
+        body: JSON.stringify({ modelName: document.getElementById('modelSelect').value, personality: "", aiName: "AI助手", aiAvatar: "/static/ai_avatar.png" })
     });
     let data = await res.json();
     await loadSessions();
@@ -98,6 +235,46 @@ function renderSessionList() {
             </span>`;
         ul.appendChild(li);
     });
+    if (sessionsHasMore) {
+        const more = document.createElement('li');
+        more.className = 'text-sm text-blue-400 hover:text-blue-700 text-center py-2 cursor-pointer';
+        more.textContent = '加载更多';
+        more.onclick = loadMoreSessions;
+        ul.appendChild(more);
+    }
+}
+
+async function loadMoreSessions() {
+    if (sessions.length === 0) return;
+    let res = await fetch('/api/sessions?before=' + encodeURIComponent(sessions[sessions.length - 1].id));
+    if (!res.ok) return showError('加载会话失败: ' + (await res.text()));
+    let page = await res.json();
+    sessions = sessions.concat(page.items);
+    sessionsHasMore = page.hasMore;
+    renderSessionList();
+}
+
+// 检索会话名称和消息内容，结果暂时替换会话列表，清空输入框后恢复
+async function searchAll(q) {
+    if (!q) return renderSessionList();
+    let res = await fetch('/api/search?q=' + encodeURIComponent(q));
+    if (!res.ok) return showError('检索失败: ' + (await res.text()));
+    let data = await res.json();
+    const ul = document.getElementById('sessionList');
+    ul.innerHTML = '';
+    const item = (title, snippet, sid) => {
+        const li = document.createElement('li');
+        li.className = 'text-blue-700 hover:bg-blue-50 px-4 py-2 mb-2 rounded-lg cursor-pointer border transition';
+        li.onclick = () => switchSession(sid);
+        li.innerHTML = `<div class="text-xs text-blue-400 truncate">${escapeHtml(title)}</div><div class="text-sm break-all">${snippet}</div>`;
+        ul.appendChild(li);
+    };
+    // 片段由服务端转义并标记<mark>，可直接作为HTML插入
+    data.sessions.forEach(s => item('会话', s.highlight, s.sessionId));
+    data.messages.forEach(m => item(`${m.sessionName} · ${m.role === 'user' ? '用户' : 'AI'}`, m.snippet, m.sessionId));
+    if (ul.children.length === 0) {
+        ul.innerHTML = '<li class="text-sm text-blue-400 text-center mt-4">没有找到相关内容</li>';
+    }
 }
 
 // 切换会话
@@ -108,28 +285,74 @@ async function switchSession(sid) {
     document.getElementById('mainAiAvatar').src = sess ? (sess.ai_avatar || '/static/ai_avatar.png') : '/static/ai_avatar.png';
     aiName = sess ? (sess.ai_name || 'AI助手') : 'AI助手';
     aiAvatar = sess ? (sess.ai_avatar || '/static/ai_avatar.png') : '/static/ai_avatar.png';
+    showSessionModel(sess);
+    checkPersonaUpgrade();
     renderSessionList();
     await renderMessages();
 }
 
-// 聊天消息渲染
+// 聊天消息渲染：只取最近的一页，更早的消息点击顶部按钮再加载
 async function renderMessages() {
+    document.getElementById('chatMessages').innerHTML = '';
+    loadedMessages = [];
+    messagesHasMore = false;
+    if (!currentSessionId) return;
+    let res = await fetch(`/api/messages?sessionId=${currentSessionId}&order=desc&limit=50`);
+    let page = await res.json();
+    loadedMessages = page.items.reverse();
+    messagesHasMore = page.hasMore;
+    drawMessages();
+}
+
+async function loadOlderMessages() {
+    if (loadedMessages.length === 0) return;
+    let res = await fetch(`/api/messages?sessionId=${currentSessionId}&order=desc&limit=50&before=${loadedMessages[0].id}`);
+    if (!res.ok) return showError('加载消息失败: ' + (await res.text()));
+    let page = await res.json();
+    loadedMessages = page.items.reverse().concat(loadedMessages);
+    messagesHasMore = page.hasMore;
+    // 重绘后保持当前阅读位置不跳动
+    const div = document.getElementById('chatMessages');
+    const fromBottom = div.scrollHeight - div.scrollTop;
+    drawMessages();
+    div.scrollTop = div.scrollHeight - fromBottom;
+}
+
+function drawMessages() {
     const div = document.getElementById('chatMessages');
     div.innerHTML = '';
-    if (!currentSessionId) return;
-    let res = await fetch(`/api/messages?sessionId=${currentSessionId}`);
-    let msgs = await res.json();
+    const msgs = loadedMessages;
     let sess = sessions.find(s => s.id === currentSessionId);
 
+    if (messagesHasMore) {
+        const older = document.createElement('button');
+        older.className = 'block mx-auto text-sm text-blue-400 hover:text-blue-700';
+        older.textContent = '加载更早的消息';
+        older.onclick = loadOlderMessages;
+        div.appendChild(older);
+    }
     let terminated = sess?.terminated == 1 || sess?.terminated === true;
-    msgs.forEach(m => {
-        addMessageBubble(m.role, m.content, m.meta, sess?.ai_name, sess?.ai_avatar);
+    msgs.forEach((m, i) => {
+        // 群聊中每条回复显示发言人格的名字和头像
+        const bubble = addMessageBubble(m.role, m.content, m.meta, m.speaker || sess?.ai_name, m.speaker_avatar || sess?.ai_avatar);
+        if (m.role !== 'system') {
+            addBranchControls(bubble, m, !terminated, i === msgs.length - 1);
+        }
     });
+    // 识别到退出意图时等待确认，待确认的消息之后又有新消息则不再提示
+    if (!terminated && sess?.pending_exit_id && sess.pending_exit_id === sess.head_message_id) {
+        div.appendChild(exitConfirmBar());
+    }
 
     if (terminated) {
         const endDiv = document.createElement('div');
         endDiv.className = 'bg-pink-100 border border-pink-300 text-pink-700 p-4 rounded-xl text-center font-bold';
         endDiv.textContent = '本次会话已结束，感谢您的使用';
+        const reopenBtn = document.createElement('button');
+        reopenBtn.className = 'block mx-auto mt-2 text-sm font-normal text-pink-600 border border-pink-300 rounded px-3 py-1 hover:bg-pink-50';
+        reopenBtn.textContent = '重新打开会话';
+        reopenBtn.onclick = reopenSession;
+        endDiv.appendChild(reopenBtn);
         div.appendChild(endDiv);
 
         document.getElementById('messageInput').disabled = true;
@@ -151,8 +374,8 @@ function addMessageBubble(role, content, meta, aiNameParam, aiAvatarParam) {
           <img src="${aiAvatarParam || aiAvatar}" class="w-10 h-10 rounded-full border border-blue-200 bg-white object-cover" />
           <div>
             <div class="font-bold text-blue-700 mb-1">${aiNameParam || aiName}</div>
-            <div class="p-4 rounded-xl shadow-lg max-w-2xl glass text-blue-900 border border-blue-100 animate-fade-in">${marked.parse(content)}</div>
-            ${meta ? `<div class="text-xs text-blue-400 mt-2">${meta}</div>` : ''}
+            <div class="bubble-content p-4 rounded-xl shadow-lg max-w-2xl glass text-blue-900 border border-blue-100 animate-fade-in">${marked.parse(content)}</div>
+            <div class="bubble-meta text-xs text-blue-400 mt-2${meta ? '' : ' hidden'}">${meta || ''}</div>
           </div>
         </div>`;
     } else {
@@ -168,6 +391,102 @@ function addMessageBubble(role, content, meta, aiNameParam, aiAvatarParam) {
     document.getElementById('chatMessages').appendChild(div);
     document.querySelectorAll('pre code').forEach(el => hljs.highlightElement(el));
     scrollToLatest();
+    return div;
+}
+
+// 更新AI气泡内容（流式输出时逐段刷新）
+function updateAssistantBubble(bubble, content, meta) {
+    bubble.querySelector('.bubble-content').innerHTML = marked.parse(content);
+    if (meta) {
+        const metaDiv = bubble.querySelector('.bubble-meta');
+        metaDiv.textContent = meta;
+        metaDiv.classList.remove('hidden');
+    }
+    bubble.querySelectorAll('pre code').forEach(el => hljs.highlightElement(el));
+    scrollToLatest();
+}
+
+// 消息下方的分支切换、编辑和重新生成按钮
+function addBranchControls(bubble, m, editable, isLast) {
+    const bar = document.createElement('div');
+    bar.className = 'flex items-center gap-2 text-xs text-blue-400 mt-1' + (m.role === 'user' ? ' justify-end' : '');
+    if (m.siblings && m.siblings.length > 1) {
+        const idx = m.siblings.indexOf(m.id);
+        const prev = document.createElement('button');
+        prev.textContent = '‹';
+        prev.disabled = idx <= 0;
+        prev.onclick = () => switchBranch(m.siblings[idx - 1]);
+        const next = document.createElement('button');
+        next.textContent = '›';
+        next.disabled = idx >= m.siblings.length - 1;
+        next.onclick = () => switchBranch(m.siblings[idx + 1]);
+        const label = document.createElement('span');
+        label.textContent = `${idx + 1}/${m.siblings.length}`;
+        bar.append(prev, label, next);
+    }
+    if (m.role === 'user' && editable) {
+        const edit = document.createElement('button');
+        edit.className = 'hover:text-blue-700';
+        edit.textContent = '编辑';
+        edit.onclick = () => editMessage(m);
+        bar.appendChild(edit);
+    }
+    if (m.role === 'assistant' && editable && isLast) {
+        const regen = document.createElement('button');
+        regen.className = 'hover:text-blue-700';
+        regen.textContent = '重新生成';
+        regen.onclick = () => regenerateReply(m.id);
+        bar.appendChild(regen);
+    }
+    if (bar.children.length > 0) {
+        bubble.after(bar);
+    }
+}
+
+async function switchBranch(messageId) {
+    let res = await fetch('/api/session/switch_branch', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ sessionId: currentSessionId, messageId })
+    });
+    if (!res.ok) return showError('切换分支失败: ' + (await res.text()));
+    await renderMessages();
+}
+
+async function regenerateReply(messageId) {
+    if (isLoading) return;
+    isLoading = true;
+    addMessageBubble('assistant', '正在重新生成...', null, aiName, aiAvatar);
+    try {
+        let res = await fetch('/api/message/regenerate', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ sessionId: currentSessionId, messageId })
+        });
+        if (!res.ok) return showError('重新生成失败: ' + (await res.text()));
+        await renderMessages();
+    } finally {
+        isLoading = false;
+    }
+}
+
+async function editMessage(m) {
+    if (isLoading) return;
+    const content = prompt('编辑消息（将从这里重新对话，原对话保留为另一分支）', m.content);
+    if (content === null || !content.trim() || content.trim() === m.content) return;
+    isLoading = true;
+    addMessageBubble('assistant', '正在思考中...', null, aiName, aiAvatar);
+    try {
+        let res = await fetch('/api/message/edit', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ sessionId: currentSessionId, messageId: m.id, content: content.trim() })
+        });
+        if (!res.ok) return showError('编辑失败: ' + (await res.text()));
+        await renderMessages();
+    } finally {
+        isLoading = false;
+    }
 }
 
 // 滚动到底部
@@ -176,7 +495,7 @@ function scrollToLatest() {
     div.scrollTop = div.scrollHeight;
 }
 
-// 发送消息
+// 发送消息（SSE流式接收回复）
 async function sendMessage() {
     if (isLoading || !currentSessionId) return;
     const input = document.getElementById('messageInput');
@@ -184,70 +503,135 @@ async function sendMessage() {
     if (!message) return;
     input.value = '';
     isLoading = true;
-    addMessageBubble('user', message, null);
-    addMessageBubble('assistant', '正在思考中...', null, aiName, aiAvatar);
+    const userBubble = addMessageBubble('user', message, null);
+    const bubble = addMessageBubble('assistant', '正在思考中...', null, aiName, aiAvatar);
     scrollToLatest();
+    // 发送失败时服务端已撤销这条消息，把内容放回输入框方便重发
+    const restoreInput = () => {
+        userBubble.remove();
+        if (!input.value) input.value = message;
+    };
 
     try {
-        const res = await fetch('/api/chat', {
+        const res = await fetch('/api/chat/stream', {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify({ sessionId: currentSessionId, message })
         });
-        const data = await res.json();
-        removeLoadingBubble();
-
-        if (data.terminated) {
-            // 展示对话总结
-            addMessageBubble('assistant', data.summary, '对话总结');
-            const div = document.createElement('div');
-            div.className = 'bg-pink-100 border border-pink-300 text-pink-700 p-4 rounded-xl text-center font-bold';
-            div.textContent = data.endMessage || '本次会话已结束，感谢您的使用';
-            document.getElementById('chatMessages').appendChild(div);
-
-            document.getElementById('messageInput').disabled = true;
-            document.getElementById('sendBtn').disabled = true;
-            document.getElementById('terminateBtn').disabled = true;
-
-            // 自动刷新会话名
-            await loadSessions();
-            let sess = sessions.find(s => s.id === currentSessionId);
-            document.getElementById('currentSessionName').textContent = data.newTitle || (sess ? sess.name : '');
-        } else if (res.ok || data.message) {
-            addMessageBubble('assistant', data.message, '响应时间: ' + data.elapsedTime, data.aiName, data.aiAvatar);
-
-            let sess = sessions.find(s => s.id === currentSessionId);
-            if (sess && sess.name === "新对话" && !renamePollingTimer) {
-                startRenamePolling();
-            }
-        } else {
-            showError('发送失败: ' + data.message);
+        if (!res.ok) {
+            bubble.remove();
+            restoreInput();
+            showError('发送失败: ' + (await res.text()));
+            return;
         }
+        let reply = '';
+        await readEventStream(res, async (event, data) => {
+            if (event === 'start') {
+                bubble.querySelector('img').src = data.aiAvatar || aiAvatar;
+                bubble.querySelector('.font-bold').textContent = data.aiName || aiName;
+            } else if (event === 'delta') {
+                reply += data.content;
+                updateAssistantBubble(bubble, reply);
+            } else if (event === 'done') {
+                updateAssistantBubble(bubble, data.message, data.meta);
+                await renderMessages();
+            } else if (event === 'pending_exit') {
+                bubble.remove();
+                await loadSessions();
+                await renderMessages();
+            } else if (event === 'error') {
+                bubble.remove();
+                restoreInput();
+                showError('发送失败: ' + data.message);
+            }
+        });
     } catch (err) {
-        removeLoadingBubble();
+        bubble.remove();
         showError('网络错误: ' + err.message);
     } finally {
         isLoading = false;
     }
 }
 
-// 自动轮询刷新会话标题
-function startRenamePolling() {
-    let pollingCount = 0;
-    renamePollingTimer = setInterval(async () => {
-        pollingCount++;
-        await loadSessions();
-        let sess = sessions.find(s => s.id === currentSessionId);
-        if (sess && sess.name !== "新对话") {
-            clearInterval(renamePollingTimer);
-            renamePollingTimer = null;
-            renderSessionList();
+// 解析fetch返回的SSE流
+async function readEventStream(res, onEvent) {
+    const reader = res.body.getReader();
+    const decoder = new TextDecoder();
+    let buf = '';
+    while (true) {
+        const { done, value } = await reader.read();
+        if (done) break;
+        buf += decoder.decode(value, { stream: true });
+        let idx;
+        while ((idx = buf.indexOf('\n\n')) !== -1) {
+            const raw = buf.slice(0, idx);
+            buf = buf.slice(idx + 2);
+            let event = 'message', data = '';
+            raw.split('\n').forEach(line => {
+                if (line.startsWith('event:')) event = line.slice(6).trim();
+                else if (line.startsWith('data:')) data += line.slice(5).trim();
+            });
+            if (data) await onEvent(event, JSON.parse(data));
         }
-        if (pollingCount > 10) {
-            clearInterval(renamePollingTimer);
-            renamePollingTimer = null;
+    }
+}
+
+function exitConfirmBar() {
+    const bar = document.createElement('div');
+    bar.className = 'bg-pink-50 border border-pink-200 text-pink-700 p-4 rounded-xl text-center';
+    bar.innerHTML = '<div class="mb-2">看起来你想结束本次对话，确认结束吗？</div>';
+    const endBtn = document.createElement('button');
+    endBtn.className = 'mx-1 bg-pink-500 text-white rounded px-3 py-1 hover:bg-pink-600';
+    endBtn.textContent = '结束对话';
+    endBtn.onclick = () => confirmExit(true, bar);
+    const stayBtn = document.createElement('button');
+    stayBtn.className = 'mx-1 border border-pink-300 rounded px-3 py-1 hover:bg-pink-100';
+    stayBtn.textContent = '继续聊天';
+    stayBtn.onclick = () => confirmExit(false, bar);
+    bar.append(endBtn, stayBtn);
+    return bar;
+}
+
+// 确认结束时展示总结，取消时照常回复刚才那条消息
+async function confirmExit(confirmed, bar) {
+    if (isLoading || !currentSessionId) return;
+    isLoading = true;
+    let data;
+    bar.querySelectorAll('button').forEach(b => b.disabled = true);
+    try {
+        let res = await fetch('/api/session/confirm_exit', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ sessionId: currentSessionId, confirm: confirmed })
+        });
+        if (!res.ok) {
+            bar.querySelectorAll('button').forEach(b => b.disabled = false);
+            return showError((confirmed ? '结束失败: ' : '回复失败: ') + (await res.text()));
         }
-    }, 3000);
+        data = await res.json();
+        bar.remove();
+        await loadSessions();
+        await renderMessages();
+    } finally {
+        isLoading = false;
+    }
+    if (confirmed && data.summaryJobId) await showSummaryWhenDone(data.summaryJobId);
+}
+
+async function reopenSession() {
+    if (!currentSessionId) return;
+    let res = await fetch('/api/session/reopen', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ sessionId: currentSessionId })
+    });
+    if (!res.ok) return showError('重新打开失败: ' + (await res.text()));
+    let data = await res.json();
+    await loadSessions();
+    await renderMessages();
+    // 因退出意图结束时那条消息已被撤回，放回输入框
+    const input = document.getElementById('messageInput');
+    if (data.exitMessage && !input.value) input.value = data.exitMessage;
 }
 
 // 终止会话
@@ -263,18 +647,28 @@ async function terminateSession() {
     if (data.result === 'success') {
         await loadSessions();
         await renderMessages();
-        document.getElementById('currentSessionName').textContent = data.newTitle || '';
+        if (data.summaryJobId) await showSummaryWhenDone(data.summaryJobId);
     } else {
         showError('终止失败！');
     }
 }
 
-// 移除“正在思考”气泡
-function removeLoadingBubble() {
-    const bubbles = document.querySelectorAll('#chatMessages > div');
-    if (bubbles.length) {
-        const last = bubbles[bubbles.length - 1];
-        if (last.textContent.includes("正在思考")) last.remove();
+// 总结由后台任务生成，轮询任务状态，完成后刷新消息和标题
+async function showSummaryWhenDone(jobId) {
+    const sessId = currentSessionId;
+    for (let i = 0; i < 60; i++) {
+        await new Promise(r => setTimeout(r, 2000));
+        let res = await fetch('/api/jobs/' + jobId);
+        if (!res.ok) return;
+        let job = await res.json();
+        if (job.status === 'pending' || job.status === 'running') continue;
+        if (currentSessionId !== sessId) return;
+        await loadSessions();
+        await renderMessages();
+        let sess = sessions.find(s => s.id === sessId);
+        document.getElementById('currentSessionName').textContent = sess ? sess.name : '';
+        if (job.status === 'dead') showError('对话总结生成失败: ' + (job.last_error || ''));
+        return;
     }
 }
 
@@ -363,6 +757,7 @@ function renderPersonaList() {
         card.className = 'glass shadow border flex gap-3 p-3 rounded-lg items-center cursor-pointer relative group';
         card.onclick = () => showPersonaDetail(p.id);
         card.innerHTML = `
+            <input type="checkbox" class="group-pick" value="${p.id}" title="选入群聊" onclick="event.stopPropagation()" />
             <img src="${p.avatar||'/static/ai_avatar.png'}" class="w-14 h-14 rounded-full border border-blue-200 object-cover" />
             <div class="flex-1 min-w-0">
               <div class="font-bold text-blue-800 persona-card-row">${escapeHtml(p.name)}</div>
@@ -387,6 +782,10 @@ function showAddPersonaModal() {
     document.getElementById('personaIdentityInput').value = '';
     document.getElementById('personaAppearanceInput').value = '';
     document.getElementById('personaPersonalityInput').value = '';
+    document.getElementById('personaPromptTemplateInput').value = '';
+    document.getElementById('promptPreview').classList.add('hidden');
+    fillParamInputs({});
+    document.getElementById('personaHistory').classList.add('hidden');
     document.getElementById('personaModal').classList.remove('hidden');
 }
 
@@ -401,33 +800,174 @@ async function showEditPersonaModal(id) {
     document.getElementById('personaIdentityInput').value = p.identity||'';
     document.getElementById('personaAppearanceInput').value = p.appearance||'';
     document.getElementById('personaPersonalityInput').value = p.personality||'';
+    document.getElementById('personaPromptTemplateInput').value = p.prompt_template||'';
+    document.getElementById('promptPreview').classList.add('hidden');
+    fillParamInputs(p.params || {});
+    loadPersonaRevisions(p.id);
     document.getElementById('personaModal').classList.remove('hidden');
 }
 
+// 人格的历史版本，可与上一版对比或回滚
+async function loadPersonaRevisions(personaId) {
+    const box = document.getElementById('personaRevisionList');
+    document.getElementById('personaDiffView').classList.add('hidden');
+    box.innerHTML = '';
+    let res = await fetch(`/api/persona/${personaId}/revisions`);
+    if (!res.ok) return;
+    let revs = await res.json();
+    document.getElementById('personaHistory').classList.toggle('hidden', revs.length === 0);
+    revs.forEach((r, i) => {
+        const row = document.createElement('div');
+        row.className = 'flex items-center gap-2 text-blue-700';
+        const note = r.rolled_back_from ? `（回滚自v${r.rolled_back_from}）` : '';
+        row.innerHTML = `<span class="flex-1">v${r.version} · ${new Date(r.created_at).toLocaleString()}${note}</span>`;
+        if (r.version > 1) {
+            const diffBtn = document.createElement('button');
+            diffBtn.className = 'text-xs text-blue-500 hover:text-blue-800';
+            diffBtn.textContent = '对比上一版';
+            diffBtn.onclick = () => showPersonaDiff(personaId, r.version - 1, r.version);
+            row.appendChild(diffBtn);
+        }
+        if (i > 0) {
+            const rbBtn = document.createElement('button');
+            rbBtn.className = 'text-xs text-pink-500 hover:text-pink-700';
+            rbBtn.textContent = '回滚';
+            rbBtn.onclick = () => rollbackPersona(personaId, r.version);
+            row.appendChild(rbBtn);
+        }
+        box.appendChild(row);
+    });
+}
+
+async function showPersonaDiff(personaId, from, to) {
+    let res = await fetch(`/api/persona/${personaId}/diff?from=${from}&to=${to}`);
+    if (!res.ok) return showError('对比失败: ' + (await res.text()));
+    let data = await res.json();
+    const view = document.getElementById('personaDiffView');
+    let text = `v${data.from} → v${data.to}\n`;
+    if (data.changes.length === 0) text += '内容没有变化\n';
+    data.changes.forEach(c => {
+        text += `\n[${c.field}]\n`;
+        if (c.lines) {
+            c.lines.forEach(l => { text += `${l.op} ${l.text}\n`; });
+        } else {
+            text += `- ${c.from}\n+ ${c.to}\n`;
+        }
+    });
+    view.textContent = text;
+    view.classList.remove('hidden');
+}
+
+async function rollbackPersona(personaId, version) {
+    if (!confirm(`确定把人格恢复为v${version}吗？已有会话仍使用原来的版本，可手动升级。`)) return;
+    let res = await fetch(`/api/persona/${personaId}/rollback`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ version })
+    });
+    if (!res.ok) return showError('回滚失败: ' + (await res.text()));
+    await loadPersonas();
+    showEditPersonaModal(personaId);
+}
+
+// 当前会话固定的人格有新版本时显示升级按钮
+async function checkPersonaUpgrade() {
+    const btn = document.getElementById('upgradePersonaBtn');
+    btn.classList.add('hidden');
+    if (!currentSessionId) return;
+    const sid = currentSessionId;
+    let res = await fetch('/api/session/persona_revision?sessionId=' + encodeURIComponent(sid));
+    if (!res.ok || sid !== currentSessionId) return;
+    let data = await res.json();
+    if (data.upgradeAvailable) {
+        btn.title = data.personas.filter(p => p.version < p.latestVersion)
+            .map(p => `${p.name}：v${p.version} → v${p.latestVersion}`).join('\n');
+        btn.classList.remove('hidden');
+    }
+}
+
+async function upgradeSessionPersona() {
+    if (!currentSessionId) return;
+    let res = await fetch('/api/session/upgrade_persona', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ sessionId: currentSessionId })
+    });
+    if (!res.ok) return showError('升级失败: ' + (await res.text()));
+    await loadSessions();
+    await switchSession(currentSessionId);
+}
+
+// 生成参数输入框，空值表示使用模型默认值
+const paramInputs = {
+    temperature: 'paramTemperature',
+    top_p: 'paramTopP',
+    max_tokens: 'paramMaxTokens',
+    presence_penalty: 'paramPresencePenalty',
+    frequency_penalty: 'paramFrequencyPenalty'
+};
+
+function fillParamInputs(params) {
+    for (const [key, id] of Object.entries(paramInputs)) {
+        document.getElementById(id).value = params[key] ?? '';
+    }
+    document.getElementById('paramStop').value = (params.stop || []).join('\n');
+}
+
+function readParamInputs() {
+    const params = {};
+    for (const [key, id] of Object.entries(paramInputs)) {
+        const v = document.getElementById(id).value.trim();
+        if (v !== '') params[key] = Number(v);
+    }
+    const stop = document.getElementById('paramStop').value.split('\n').filter(s => s !== '');
+    if (stop.length > 0) params.stop = stop;
+    return params;
+}
+
+// 按编辑中的内容渲染最终的system prompt
+async function previewPersonaPrompt() {
+    let res = await fetch('/api/persona/preview_prompt', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ ...readPersonaForm(), sessionId: currentSessionId || '' })
+    });
+    const view = document.getElementById('promptPreview');
+    view.textContent = res.ok ? (await res.json()).prompt : await res.text();
+    view.classList.remove('hidden');
+}
+
 function closePersonaModal() {
     document.getElementById('personaModal').classList.add('hidden');
 }
 
-async function savePersona() {
-    let id = document.getElementById('personaIdInput').value;
-    let data = {
-        id: id ? Number(id) : undefined,
+function readPersonaForm() {
+    return {
         name: document.getElementById('personaNameInput').value.trim(),
         avatar: personaAvatarTemp,
         identity: document.getElementById('personaIdentityInput').value.trim(),
         appearance: document.getElementById('personaAppearanceInput').value.trim(),
-        personality: document.getElementById('personaPersonalityInput').value.trim()
+        personality: document.getElementById('personaPersonalityInput').value.trim(),
+        prompt_template: document.getElementById('personaPromptTemplateInput').value.trim(),
+        params: readParamInputs()
     };
+}
+
+async function savePersona() {
+    let id = document.getElementById('personaIdInput').value;
+    let data = { id: id ? Number(id) : undefined, ...readPersonaForm() };
     if (!data.name) return showError('名称不能为空');
     let res = await fetch('/api/persona', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify(data)
     });
+    if (!res.ok) return showError('保存失败: ' + (await res.text()));
     let resp = await res.json();
     if (resp.result === 'success') {
         await loadPersonas();
         closePersonaModal();
+        checkPersonaUpgrade();
     } else {
         showError('保存失败');
     }
@@ -462,6 +1002,26 @@ async function usePersonaForCurrentSession(personaId) {
     }
 }
 
+// 用勾选的人格新建群聊，勾选顺序不影响发言顺序，按列表顺序轮流
+async function createGroupChat() {
+    const ids = [...document.querySelectorAll('#personaList .group-pick:checked')].map(el => Number(el.value));
+    if (ids.length < 2) return showError('请至少勾选两个人格');
+    let res = await fetch('/api/setup', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({
+            modelName: document.getElementById('modelSelect').value,
+            personaIds: ids,
+            turnMode: document.getElementById('turnModeSelect').value
+        })
+    });
+    if (!res.ok) return showError('创建群聊失败: ' + (await res.text()));
+    let data = await res.json();
+    await loadSessions();
+    await switchSession(data.sessionId);
+    document.getElementById('settingsPanel').classList.add('hidden');
+}
+
 let currentDetailPersonaId = null;
 async function showPersonaDetail(personaId) {
     currentDetailPersonaId = personaId;
@@ -488,6 +1048,23 @@ document.getElementById('closePersonaDetailBtn').onclick = function () {
     document.getElementById('personaDetailModal').classList.add('hidden');
 };
 
+// 导入角色卡（V2 JSON或内嵌卡片的PNG）
+async function importPersonaCard() {
+    const input = document.getElementById('importPersonaInput');
+    if (!input.files || !input.files[0]) return;
+    const fd = new FormData();
+    fd.append('card', input.files[0]);
+    input.value = '';
+    let res = await fetch('/api/persona/import', { method: 'POST', body: fd });
+    if (!res.ok) return alert('导入失败: ' + (await res.text()));
+    await loadPersonas();
+}
+
+function exportPersonaCard(format) {
+    if (!currentDetailPersonaId) return;
+    location.href = `/api/persona/${currentDetailPersonaId}/export?format=${format}`;
+}
+
 // “详情”弹窗内“修改人格”按钮
 document.getElementById('editPersonaBtn').onclick = function() {
     document.getElementById('personaDetailModal').classList.add('hidden');
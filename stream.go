@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sseWriter 向浏览器写Server-Sent Events
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseWriter{w: w, flusher: flusher}, true
+}
+
+func (s *sseWriter) send(event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// handleChatStream 与handleChat流程相同，但模型输出通过SSE逐段推送：
+// start -> delta... -> done，出错时推送error，触发退出意图时推送pending_exit
+func handleChatStream(w http.ResponseWriter, r *http.Request) {
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	session, ok := loadActiveSession(w, currentUserID(r), req.SessionID)
+	if !ok {
+		return
+	}
+	if !checkSpeaker(w, session, req.SpeakerID) {
+		return
+	}
+	if !enforceLimits(w, currentUserID(r), session.ID) {
+		return
+	}
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "不支持流式输出", http.StatusInternalServerError)
+		return
+	}
+
+	if checkExitIntent(session, req.Message, sessionPersonality(session)) {
+		resp, err := markPendingExit(session, req.Message)
+		if err != nil {
+			sse.send("error", map[string]string{"message": "保存消息失败"})
+			return
+		}
+		sse.send("pending_exit", resp)
+		return
+	}
+
+	speaker, err := speakerSession(session, session.HeadMessageID, req.Message, req.SpeakerID)
+	if err != nil {
+		sse.send("error", map[string]string{"message": "选择回复成员失败"})
+		return
+	}
+	chatMsgs, ctxStats, err := buildChatMessages(speaker, session.HeadMessageID, req.Message)
+	if err != nil {
+		sse.send("error", map[string]string{"message": "获取历史消息失败"})
+		return
+	}
+	userMsg, err := saveUserMessage(session, req.Message)
+	if err != nil {
+		sse.send("error", map[string]string{"message": "保存消息失败"})
+		return
+	}
+	sse.send("start", map[string]string{
+		"aiName":   speaker.AIName,
+		"aiAvatar": speaker.AIAvatar,
+	})
+
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.Timeouts.Stream.Duration)
+	defer cancel()
+	startTime := time.Now()
+	model := modelFor(speaker)
+	response, err := model.provider.Stream(ctx, CompletionRequest{
+		Model:    model.Model,
+		Messages: chatMsgs,
+		Params:   sessionParams(speaker),
+	}, func(delta string) error {
+		return sse.send("delta", map[string]string{"content": delta})
+	})
+	elapsedTime := time.Since(startTime)
+	if err != nil {
+		log.Printf("流式调用失败 session=%s: %v", req.SessionID, err)
+		discardUserMessage(session, userMsg)
+		sse.send("error", map[string]string{"message": newUpstreamError(err).Message})
+		return
+	}
+	aiMsg, err := saveAssistantReply(speaker, userMsg.ID, response, elapsedTime)
+	if err != nil {
+		log.Printf("会话%s保存回复失败: %v", session.ID, err)
+		discardUserMessage(session, userMsg)
+		sse.send("error", map[string]string{"message": "保存回复失败"})
+		return
+	}
+	scheduleMemoryUpdate(session)
+
+	sse.send("done", chatReplyResponse(speaker, aiMsg, response, elapsedTime, ctxStats))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+// 识别到退出意图时不再直接终止：先保存这条用户消息并把会话标记为待确认，由用户确认结束或取消；
+// 取消时照常回复这条消息。会话结束后也可以重新打开，删除结束提示和总结后继续对话
+
+// pendingExitText 待确认时提示用户的文字
+const pendingExitText = "看起来你想结束本次对话，确认结束吗？"
+
+// isPendingExit 待确认的消息仍是当前分支的最后一条时才有效；之后又发了消息、重新生成或切换了分支都视为取消
+func isPendingExit(session Session) bool {
+	return session.PendingExitID != nil && session.HeadMessageID != nil && *session.PendingExitID == *session.HeadMessageID
+}
+
+// markPendingExit 保存触发退出意图的用户消息并等待确认
+func markPendingExit(session Session, message string) (map[string]interface{}, error) {
+	userMsg, err := saveUserMessage(session, message)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Model(&Session{}).Where("id = ?", session.ID).Update("pending_exit_id", userMsg.ID).Error; err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"pendingExit": true,
+		"messageId":   userMsg.ID,
+		"message":     pendingExitText,
+	}, nil
+}
+
+type ConfirmExitRequest struct {
+	SessionID string `json:"sessionId"`
+	// Confirm 为true时结束对话，为false时取消并回复待确认的消息
+	Confirm bool `json:"confirm"`
+}
+
+func confirmExit(w http.ResponseWriter, r *http.Request) {
+	var req ConfirmExitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	session, ok := loadActiveSession(w, currentUserID(r), req.SessionID)
+	if !ok {
+		return
+	}
+	if !isPendingExit(session) {
+		http.Error(w, "没有待确认的结束请求", http.StatusConflict)
+		return
+	}
+	if !enforceLimits(w, currentUserID(r), session.ID) {
+		return
+	}
+	if req.Confirm {
+		job, err := finishSession(session)
+		if err != nil {
+			http.Error(w, "结束失败", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(terminatedResponse(job))
+		return
+	}
+
+	userMsg, err := findMessage(session.ID, *session.PendingExitID)
+	if err != nil {
+		http.Error(w, "消息不存在", http.StatusNotFound)
+		return
+	}
+	resp, err := replyTo(session, userMsg, nil)
+	if err != nil {
+		writeReplyError(w, err)
+		return
+	}
+	db.Model(&Session{}).Where("id = ?", session.ID).Update("pending_exit_id", nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type ReopenSessionRequest struct {
+	SessionID string `json:"sessionId"`
+}
+
+// reopenSession 撤销会话的终止：删除当前分支末尾的结束提示和总结，回到结束前的最后一条消息，并恢复结束前的名称。
+// 因退出意图结束时，触发结束的用户消息没有回复，一并删除并在exitMessage中返回，避免之后出现连续两条用户消息
+func reopenSession(w http.ResponseWriter, r *http.Request) {
+	var req ReopenSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		http.Error(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	session, err := findSession(currentUserID(r), req.SessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !session.Terminated {
+		http.Error(w, "对话未终止", http.StatusBadRequest)
+		return
+	}
+	path, err := activePath(session)
+	if err != nil {
+		http.Error(w, "获取消息失败", http.StatusInternalServerError)
+		return
+	}
+	cut := len(path)
+	for cut > 0 && isSyntheticMessage(path[cut-1]) {
+		cut--
+	}
+	exitMessage := ""
+	if cut > 0 && session.ExitMessageID != nil && path[cut-1].ID == *session.ExitMessageID {
+		cut--
+		exitMessage = path[cut].Content
+	}
+	var ids []uint
+	for _, m := range path[cut:] {
+		ids = append(ids, m.ID)
+	}
+	var head *uint
+	if cut > 0 {
+		head = &path[cut-1].ID
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if len(ids) > 0 {
+			if err := tx.Where("session_id = ? AND id IN ?", session.ID, ids).Delete(&Message{}).Error; err != nil {
+				return err
+			}
+		}
+		updates := map[string]interface{}{
+			"terminated":      false,
+			"head_message_id": head,
+			"pending_exit_id": nil,
+			"exit_message_id": nil,
+			"name_before_end": "",
+		}
+		if session.NameBeforeEnd != "" {
+			updates["name"] = session.NameBeforeEnd
+		}
+		return tx.Model(&Session{}).Where("id = ?", session.ID).Updates(updates).Error
+	})
+	if err != nil {
+		http.Error(w, "重新打开失败", http.StatusInternalServerError)
+		return
+	}
+	events.publish(currentUserID(r), Event{Type: eventSessionReopened, SessionID: session.ID})
+	name := session.Name
+	if session.NameBeforeEnd != "" {
+		name = session.NameBeforeEnd
+		events.publish(currentUserID(r), Event{Type: eventSessionRenamed, SessionID: session.ID, Name: name})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result":        "success",
+		"headMessageId": head,
+		"removed":       len(ids),
+		"exitMessage":   exitMessage,
+		"name":          name,
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 模型调用的类型：对话回复之外，退出意图判断、生成标题、结束总结、滚动摘要和群聊挑选发言人都会消耗token
+const (
+	usageChat       = "chat"
+	usageExitIntent = "exit_intent"
+	usageTitle      = "title"
+	usageSummary    = "summary"
+	usageMemory     = "memory"
+	usageSpeaker    = "speaker"
+)
+
+// UsageRecord 一次模型调用的token用量、耗时和费用。费用按调用时的价格表计算后保存，之后调价不影响历史记录；
+// 会话和人格只记ID不加外键，删除后统计数据仍然保留
+type UsageRecord struct {
+	ID               uint      `gorm:"primaryKey;size:32" json:"id"`
+	UserID           *uint     `gorm:"size:32;index" json:"user_id"`
+	User             *User     `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+	SessionID        string    `gorm:"type:varchar(64);index" json:"session_id"`
+	PersonaID        *uint     `gorm:"size:32;index" json:"persona_id"`
+	MessageID        *uint     `gorm:"size:32" json:"message_id"`
+	Kind             string    `gorm:"type:varchar(16)" json:"kind"`
+	Model            string    `gorm:"type:varchar(64)" json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Cost             float64   `json:"cost"`
+	CreatedAt        time.Time `gorm:"index" json:"created_at"`
+}
+
+// priceFor 取最长前缀匹配的模型价格，未配置时返回零价格
+func priceFor(model string) ModelPrice {
+	name := strings.ToLower(strings.TrimSpace(model))
+	best, price := -1, ModelPrice{}
+	for prefix, p := range cfg.Pricing.Models {
+		prefix = strings.ToLower(prefix)
+		if strings.HasPrefix(name, prefix) && len(prefix) > best {
+			best, price = len(prefix), p
+		}
+	}
+	return price
+}
+
+// cost 单价为每百万token的价格
+func (p ModelPrice) cost(u Usage) float64 {
+	return (float64(u.PromptTokens)*p.Prompt + float64(u.CompletionTokens)*p.Completion) / 1e6
+}
+
+// recordUsage 记录一次模型调用，失败只打日志，不影响对话
+func recordUsage(session Session, kind, model string, messageID *uint, usage Usage, elapsed time.Duration) {
+	total := usage.TotalTokens
+	if total == 0 {
+		total = usage.PromptTokens + usage.CompletionTokens
+	}
+	rec := UsageRecord{
+		UserID:           session.UserID,
+		SessionID:        session.ID,
+		PersonaID:        session.PersonaID,
+		MessageID:        messageID,
+		Kind:             kind,
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      total,
+		LatencyMs:        elapsed.Milliseconds(),
+		Cost:             priceFor(model).cost(usage),
+	}
+	if err := db.Create(&rec).Error; err != nil {
+		log.Printf("会话%s记录用量失败: %v", session.ID, err)
+	}
+}
+
+// UsageStat 一组调用的合计
+type UsageStat struct {
+	Key              string  `json:"key"`
+	Name             string  `json:"name,omitempty"`
+	Calls            int64   `json:"calls"`
+	PromptTokens     int64   `json:"promptTokens"`
+	CompletionTokens int64   `json:"completionTokens"`
+	TotalTokens      int64   `json:"totalTokens"`
+	AvgLatencyMs     float64 `json:"avgLatencyMs"`
+	Cost             float64 `json:"cost"`
+}
+
+// usageGroupColumns groupBy参数对应的分组字段，day见usageDayColumn
+var usageGroupColumns = map[string]string{
+	"session": "session_id",
+	"persona": "persona_id",
+	"day":     "DATE(created_at)",
+	"model":   "model",
+	"kind":    "kind",
+}
+
+// usageDayColumn 按本地日期分组。MySQL按DSN的loc=Local读写本地时间；SQLite保存的时间带时区偏移，
+// DATE()会先换算成UTC，需要加localtime，否则与MySQL以及按本地零点计算的每日限额不一致
+func usageDayColumn() string {
+	if db.Dialector.Name() == "sqlite" {
+		return "DATE(created_at, 'localtime')"
+	}
+	return usageGroupColumns["day"]
+}
+
+const usageAggregates = "COUNT(*) AS calls, COALESCE(SUM(prompt_tokens), 0) AS prompt_tokens, COALESCE(SUM(completion_tokens), 0) AS completion_tokens, " +
+	"COALESCE(SUM(total_tokens), 0) AS total_tokens, COALESCE(AVG(latency_ms), 0) AS avg_latency_ms, COALESCE(SUM(cost), 0) AS cost"
+
+// handleUsage 当前用户的用量统计：groupBy=session|persona|day|model|kind（默认day），
+// 可选筛选 sessionId、personaId、kind、from/to（YYYY-MM-DD）
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupBy := q.Get("groupBy")
+	if groupBy == "" {
+		groupBy = "day"
+	}
+	column, ok := usageGroupColumns[groupBy]
+	if !ok {
+		http.Error(w, "groupBy只能是session、persona、day、model或kind", http.StatusBadRequest)
+		return
+	}
+	if groupBy == "day" {
+		column = usageDayColumn()
+	}
+	from, to, err := parseDateRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	base := db.Model(&UsageRecord{}).Where("user_id = ?", currentUserID(r))
+	if v := q.Get("sessionId"); v != "" {
+		base = base.Where("session_id = ?", v)
+	}
+	if v := q.Get("personaId"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			http.Error(w, "personaId格式错误", http.StatusBadRequest)
+			return
+		}
+		base = base.Where("persona_id = ?", id)
+	}
+	if v := q.Get("kind"); v != "" {
+		base = base.Where("kind = ?", v)
+	}
+	if from != nil {
+		base = base.Where("created_at >= ?", *from)
+	}
+	if to != nil {
+		base = base.Where("created_at < ?", *to)
+	}
+
+	var total UsageStat
+	if err := base.Session(&gorm.Session{}).Select(usageAggregates).Scan(&total).Error; err != nil {
+		http.Error(w, "统计失败", http.StatusInternalServerError)
+		return
+	}
+	var rows []struct {
+		GroupKey *string
+		UsageStat
+	}
+	err = base.Session(&gorm.Session{}).Select(column + " AS group_key, " + usageAggregates).
+		Group(column).Order("cost desc").Order("total_tokens desc").Scan(&rows).Error
+	if err != nil {
+		http.Error(w, "统计失败", http.StatusInternalServerError)
+		return
+	}
+	groups := make([]UsageStat, 0, len(rows))
+	for _, row := range rows {
+		stat := row.UsageStat
+		if row.GroupKey != nil {
+			stat.Key = *row.GroupKey
+		}
+		groups = append(groups, stat)
+	}
+	if groupBy == "day" {
+		sort.Slice(groups, func(i, j int) bool { return groups[i].Key < groups[j].Key })
+	}
+	fillUsageNames(groupBy, groups)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"groupBy":  groupBy,
+		"currency": cfg.Pricing.Currency,
+		"total":    total,
+		"groups":   groups,
+	})
+}
+
+// fillUsageNames 按会话、人格分组时补上名称，已删除的保持为空
+func fillUsageNames(groupBy string, groups []UsageStat) {
+	var keys []string
+	for _, g := range groups {
+		if g.Key != "" {
+			keys = append(keys, g.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	names := make(map[string]string)
+	switch groupBy {
+	case "session":
+		var sessions []Session
+		db.Select("id", "name").Where("id IN ?", keys).Find(&sessions)
+		for _, s := range sessions {
+			names[s.ID] = s.Name
+		}
+	case "persona":
+		var personas []Persona
+		db.Select("id", "name").Where("id IN ?", keys).Find(&personas)
+		for _, p := range personas {
+			names[strconv.FormatUint(uint64(p.ID), 10)] = p.Name
+		}
+	default:
+		return
+	}
+	for i := range groups {
+		groups[i].Name = names[groups[i].Key]
+	}
+}